@@ -0,0 +1,192 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+const archiveIndexFile = "index.json"
+
+var archiveDir = "archive"
+
+// archiveEntry describes one fetched version of the CRL behind a URL.
+// The CRL itself is stored once per content under archive/objects.
+type archiveEntry struct {
+	SHA256     string    `json:"sha256"`
+	URL        string    `json:"url"`
+	Path       string    `json:"path"`
+	Number     string    `json:"crlNumber,omitempty"`
+	ThisUpdate time.Time `json:"thisUpdate"`
+	NextUpdate time.Time `json:"nextUpdate,omitempty"`
+	FetchedAt  time.Time `json:"fetchedAt"`
+}
+
+// crlArchive keeps every distinct CRL version we downloaded.
+type crlArchive struct {
+	mu      sync.Mutex
+	Entries []archiveEntry `json:"entries"`
+	// byURL indexes Entries by URL, oldest first.
+	byURL map[string][]archiveEntry
+}
+
+// loadArchive reads the archive index. A missing index is an empty archive.
+func loadArchive() (*crlArchive, error) {
+	a := &crlArchive{}
+	data, err := os.ReadFile(filepath.Join(archiveDir, archiveIndexFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return a, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, a); err != nil {
+		return nil, err
+	}
+	a.index()
+	return a, nil
+}
+
+// index rebuilds byURL from Entries. The caller holds a.mu or owns a.
+func (a *crlArchive) index() {
+	a.byURL = map[string][]archiveEntry{}
+	for _, e := range a.Entries {
+		a.byURL[e.URL] = append(a.byURL[e.URL], e)
+	}
+	for _, entries := range a.byURL {
+		sort.SliceStable(entries, func(i, j int) bool { return entries[i].FetchedAt.Before(entries[j].FetchedAt) })
+	}
+}
+
+func archiveObjectPath(digest string) string {
+	return filepath.Join(archiveDir, "objects", digest+".crl")
+}
+
+// add stores a freshly downloaded CRL unless it is the version we already
+// have as the latest one for this URL.
+func (a *crlArchive) add(url, path, digest string, body []byte, crl *x509.RevocationList, fetchedAt time.Time) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if latest, ok := a.latest(url); ok && latest.SHA256 == digest {
+		return nil
+	}
+
+	object := archiveObjectPath(digest)
+	if _, err := os.Stat(object); os.IsNotExist(err) {
+		if err := os.MkdirAll(filepath.Dir(object), 0755); err != nil {
+			return err
+		}
+		if err := writeFileAtomic(object, body); err != nil {
+			return err
+		}
+	}
+
+	entry := archiveEntry{
+		SHA256:     digest,
+		URL:        url,
+		Path:       path,
+		ThisUpdate: crl.ThisUpdate,
+		NextUpdate: crl.NextUpdate,
+		FetchedAt:  fetchedAt,
+	}
+	if crl.Number != nil {
+		entry.Number = crl.Number.String()
+	}
+	a.Entries = append(a.Entries, entry)
+	if a.byURL == nil {
+		a.byURL = map[string][]archiveEntry{}
+	}
+	entries := append(a.byURL[url], entry)
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].FetchedAt.Before(entries[j].FetchedAt) })
+	a.byURL[url] = entries
+	return nil
+}
+
+// latest returns the most recently fetched version of url. The caller holds a.mu.
+func (a *crlArchive) latest(url string) (archiveEntry, bool) {
+	entries := a.byURL[url]
+	if len(entries) == 0 {
+		return archiveEntry{}, false
+	}
+	return entries[len(entries)-1], true
+}
+
+// versions returns all archived versions of url, oldest first.
+func (a *crlArchive) versions(url string) []archiveEntry {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return slices.Clone(a.byURL[url])
+}
+
+// load parses an archived CRL version.
+func (e archiveEntry) load() (*x509.RevocationList, error) {
+	data, err := os.ReadFile(archiveObjectPath(e.SHA256))
+	if err != nil {
+		return nil, err
+	}
+	_, crl, err := parseCRL(data)
+	return crl, err
+}
+
+// prune applies the retention policy: per URL at most keep versions and none
+// older than maxAge. The latest version of every URL is always kept.
+// Objects no longer referenced by any entry are deleted.
+func (a *crlArchive) prune(keep int, maxAge time.Duration) (removed int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var kept []archiveEntry
+	now := time.Now()
+	for _, entries := range a.byURL {
+		for i := range entries {
+			// Newest first
+			e := entries[len(entries)-1-i]
+			tooMany := keep > 0 && i >= keep
+			tooOld := maxAge > 0 && now.Sub(e.FetchedAt) > maxAge
+			if i > 0 && (tooMany || tooOld) {
+				removed++
+				continue
+			}
+			kept = append(kept, e)
+		}
+	}
+	sort.Slice(kept, func(i, j int) bool { return kept[i].FetchedAt.Before(kept[j].FetchedAt) })
+	a.Entries = kept
+	a.index()
+
+	referenced := map[string]bool{}
+	for _, e := range a.Entries {
+		referenced[e.SHA256] = true
+	}
+	objects, _ := filepath.Glob(archiveObjectPath("*"))
+	for _, object := range objects {
+		digest := filepath.Base(object)
+		digest = digest[:len(digest)-len(filepath.Ext(digest))]
+		if !referenced[digest] {
+			if err := os.Remove(object); err != nil {
+				logln("Failed to remove archived CRL", object, "error:", err)
+			}
+		}
+	}
+	return removed
+}
+
+// save writes the archive index.
+func (a *crlArchive) save() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := os.MkdirAll(archiveDir, 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(a, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(archiveDir, archiveIndexFile), data)
+}
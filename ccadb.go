@@ -0,0 +1,452 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ccadbCacheDir keeps the last good copy of every CCADB report.
+var ccadbCacheDir = "ccadb"
+
+var (
+	ccadbURL       = new(string)
+	ccadbFile      = new(string)
+	ccadbRootsURL  = new(string)
+	ccadbRootsFile = new(string)
+	ccadbAllURL    = new(string)
+	ccadbAllFile   = new(string)
+	updateStores   = new(string)
+)
+
+// Root stores of the root programs that publish through CCADB.
+const (
+	storeMozilla   = "mozilla"
+	storeChrome    = "chrome"
+	storeApple     = "apple"
+	storeMicrosoft = "microsoft"
+)
+
+var rootStores = []string{storeMozilla, storeChrome, storeApple, storeMicrosoft}
+
+// rootProgramStores maps the root program names of the "Status of Root Cert"
+// column to our store names.
+var rootProgramStores = map[string]string{
+	"mozilla":       storeMozilla,
+	"google chrome": storeChrome,
+	"chrome":        storeChrome,
+	"apple":         storeApple,
+	"microsoft":     storeMicrosoft,
+}
+
+// fieldAliases lists other names the CCADB reports use for a column.
+var fieldAliases = map[string][]string{
+	fieldPEM:       {"X.509 Certificate (PEM)"},
+	fieldCAOwner:   {fieldOwner},
+	fieldSubjectCN: {"Certificate Name"},
+	fieldTrustBits: {"Derived Trust Bits"},
+}
+
+// columnIndex returns the index of a column by its name or one of its aliases.
+func columnIndex(index map[string]int, name string) (int, bool) {
+	if i, ok := index[name]; ok {
+		return i, true
+	}
+	for _, alias := range fieldAliases[name] {
+		if i, ok := index[alias]; ok {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// ccadbSource is a CCADB report listing CA certificates. row turns a report
+// row into a CA and returns false for rows that are skipped.
+type ccadbSource struct {
+	name      string
+	url       *string
+	file      *string
+	stores    []string // root stores the report can tell us about
+	listsCRLs bool
+	required  []string
+	row       func(record []string, index map[string]int) (caEntry, bool)
+}
+
+var ccadbSources = []ccadbSource{
+	{
+		name:     "roots",
+		url:      ccadbRootsURL,
+		file:     ccadbRootsFile,
+		stores:   []string{storeMozilla},
+		required: []string{fieldPEM},
+		row:      mozillaRootRow,
+	},
+	{
+		name:      "intermediates",
+		url:       ccadbURL,
+		file:      ccadbFile,
+		stores:    []string{storeMozilla},
+		listsCRLs: true,
+		required:  []string{fieldSubject, fieldIssuer, fieldFullCRL, fieldPartitioned},
+		row:       mozillaIntermediateRow,
+	},
+	{
+		name:      "all-certificates",
+		url:       ccadbAllURL,
+		file:      ccadbAllFile,
+		stores:    []string{storeChrome, storeApple, storeMicrosoft}, // Mozilla has its own reports
+		listsCRLs: true,
+		required:  []string{fieldFingerprint, fieldRootStatus, fieldFullCRL, fieldPartitioned},
+		row:       allCertificatesRow,
+	},
+}
+
+// caEntry is a CA certificate merged from all CCADB reports by fingerprint.
+type caEntry struct {
+	fingerprint string
+	pemInfo     string
+	subject     string // full DN, if the report has it
+	subjectCN   string
+	issuer      string // issuer DN, if the report has it
+	trustBits   string
+	sources     []string // reports or files the CA was found in
+	owner       string
+	root        bool
+	stores      map[string]bool
+	crlURLs     []string
+	malformed   []string      // fragments of the partitioned CRL list that are not a URL
+	cadence     time.Duration // expected publication interval, custom sources only
+}
+
+func (e caEntry) name() string {
+	if e.subject != "" {
+		return e.subject
+	}
+	if e.subjectCN != "" {
+		return e.subjectCN
+	}
+	return e.fingerprint
+}
+
+func (e caEntry) storeList() []string {
+	var out []string
+	for _, store := range rootStores {
+		if e.stores[store] {
+			out = append(out, store)
+		}
+	}
+	return out
+}
+
+// merge adds what another report knows about the same certificate.
+func (e *caEntry) merge(o caEntry) {
+	e.pemInfo = cmp.Or(e.pemInfo, o.pemInfo)
+	e.subject = cmp.Or(e.subject, o.subject)
+	e.subjectCN = cmp.Or(e.subjectCN, o.subjectCN)
+	e.issuer = cmp.Or(e.issuer, o.issuer)
+	e.trustBits = cmp.Or(e.trustBits, o.trustBits)
+	for _, source := range o.sources {
+		if !slices.Contains(e.sources, source) {
+			e.sources = append(e.sources, source)
+		}
+	}
+	e.owner = cmp.Or(e.owner, o.owner)
+	e.cadence = cmp.Or(e.cadence, o.cadence)
+	e.root = e.root || o.root
+	for store := range o.stores {
+		e.stores[store] = true
+	}
+	for _, url := range o.crlURLs {
+		if !slices.Contains(e.crlURLs, url) {
+			e.crlURLs = append(e.crlURLs, url)
+		}
+	}
+	for _, fragment := range o.malformed {
+		if !slices.Contains(e.malformed, fragment) {
+			e.malformed = append(e.malformed, fragment)
+		}
+	}
+}
+
+// parseStores validates a comma separated list of root stores. An empty list
+// skips CCADB, e.g. to only monitor custom sources.
+func parseStores(list string) ([]string, error) {
+	var out []string
+	for _, store := range splitList(list) {
+		store = strings.ToLower(store)
+		if !slices.Contains(rootStores, store) {
+			return nil, fmt.Errorf("unknown root store %q, use one of %s", store, strings.Join(rootStores, ", "))
+		}
+		out = append(out, store)
+	}
+	return out, nil
+}
+
+// loadCAs reads the CCADB reports of the selected root stores and merges their
+// CAs by fingerprint. Only the selected stores are kept as tags, CAs not in
+// any of them are dropped. loaded names the reports that could be loaded,
+// only their CAs are complete.
+func loadCAs(stores []string) (cas []caEntry, loaded []string, err error) {
+	byKey := map[string]*caEntry{}
+	var keys []string
+	var listing int
+	for _, src := range ccadbSources {
+		if !slices.ContainsFunc(src.stores, func(s string) bool { return slices.Contains(stores, s) }) {
+			continue
+		}
+		report, err := loadCCADBReport(src.name, *src.file, *src.url, src.required...)
+		if err != nil {
+			logf("Error loading CCADB %s report: %v\n", src.name, err)
+			continue
+		}
+		loaded = append(loaded, src.name)
+		if src.listsCRLs {
+			listing++
+		}
+
+		var rows int
+		for _, record := range report.records {
+			e, ok := src.row(record, report.index)
+			if !ok {
+				continue
+			}
+			e.sources = []string{src.name}
+			for store := range e.stores {
+				if !slices.Contains(stores, store) {
+					delete(e.stores, store)
+				}
+			}
+			if len(e.stores) == 0 {
+				continue
+			}
+			rows++
+
+			key := e.fingerprint
+			if key == "" {
+				key = normalizeDN(e.subject) + "|" + normalizeDN(e.issuer) + "|" + e.subjectCN
+			}
+			if prev, ok := byKey[key]; ok {
+				prev.merge(e)
+				continue
+			}
+			byKey[key] = &e
+			keys = append(keys, key)
+		}
+		logf("Loaded %d CAs from the CCADB %s report.\n", rows, src.name)
+	}
+	if listing == 0 {
+		return nil, nil, fmt.Errorf("no CCADB report listing CRLs could be loaded")
+	}
+
+	cas = make([]caEntry, 0, len(keys))
+	perStore := map[string]int{}
+	for _, key := range keys {
+		reportMalformed(*byKey[key])
+		cas = append(cas, *byKey[key])
+		for store := range byKey[key].stores {
+			perStore[store]++
+		}
+	}
+	for _, store := range stores {
+		logf("  %s: %d CAs\n", store, perStore[store])
+	}
+	return cas, loaded, nil
+}
+
+func mozillaRootRow(record []string, index map[string]int) (caEntry, bool) {
+	return caEntry{
+		fingerprint: normalizeFingerprint(field(record, index, fieldFingerprint)),
+		pemInfo:     field(record, index, fieldPEM),
+		subject:     field(record, index, fieldSubject),
+		owner:       field(record, index, fieldOwner),
+		trustBits:   field(record, index, fieldTrustBits),
+		root:        true,
+		stores:      map[string]bool{storeMozilla: true},
+	}, true
+}
+
+func mozillaIntermediateRow(record []string, index map[string]int) (caEntry, bool) {
+	subject := field(record, index, fieldSubject)
+	// The CN is only used to name the CA in messages, an unparsable subject has none.
+	dn, _ := parseDN(subject)
+
+	e := caEntry{
+		fingerprint: normalizeFingerprint(field(record, index, fieldFingerprint)),
+		pemInfo:     field(record, index, fieldPEM),
+		subject:     subject,
+		subjectCN:   dn.get("CN"),
+		issuer:      field(record, index, fieldIssuer),
+		trustBits:   field(record, index, fieldTrustBits),
+		owner:       field(record, index, fieldCAOwner),
+		stores:      map[string]bool{storeMozilla: true},
+	}
+	e.crlURLs, e.malformed = rowCRLURLs(record, index)
+	return e, true
+}
+
+// allCertificatesRow reads a row of the report of all CCADB certificate
+// records. The root status lists for every root program whether the root of
+// the certificate is included in its store.
+func allCertificatesRow(record []string, index map[string]int) (caEntry, bool) {
+	// "Revoked" or "Parent Cert Revoked", but not "Not Revoked".
+	if status := strings.ToLower(field(record, index, fieldRevocation)); strings.Contains(status, "revoked") && !strings.HasPrefix(status, "not") {
+		return caEntry{}, false
+	}
+	e := caEntry{
+		fingerprint: normalizeFingerprint(field(record, index, fieldFingerprint)),
+		pemInfo:     field(record, index, fieldPEM),
+		subjectCN:   field(record, index, fieldSubjectCN),
+		trustBits:   field(record, index, fieldTrustBits),
+		owner:       field(record, index, fieldCAOwner),
+		root:        strings.HasPrefix(strings.ToLower(field(record, index, fieldRecordType)), "root"),
+		stores:      map[string]bool{},
+	}
+	for _, part := range strings.Split(field(record, index, fieldRootStatus), ";") {
+		program, status, ok := strings.Cut(part, ":")
+		if !ok || !strings.HasPrefix(strings.ToLower(strings.TrimSpace(status)), "included") {
+			continue
+		}
+		if store, ok := rootProgramStores[strings.ToLower(strings.TrimSpace(program))]; ok {
+			e.stores[store] = true
+		}
+	}
+	e.crlURLs, e.malformed = rowCRLURLs(record, index)
+	return e, true
+}
+
+// rowCRLURLs returns the full and partitioned CRL URLs of a report row and
+// the fragments of the partitioned CRL list that are not a URL.
+func rowCRLURLs(record []string, index map[string]int) (urls, malformed []string) {
+	if fullCRL := field(record, index, fieldFullCRL); fullCRL != "" {
+		urls = append(urls, fullCRL)
+	}
+	if partCRLJSON := field(record, index, fieldPartitioned); partCRLJSON != "" && partCRLJSON != "[]" {
+		partitioned, bad := parsePartitionedURLs(partCRLJSON)
+		urls = append(urls, partitioned...)
+		malformed = bad
+	}
+	return urls, malformed
+}
+
+// reportMalformed emits a finding for every fragment of a partitioned CRL
+// list that could not be read as a URL.
+func reportMalformed(ca caEntry) {
+	for _, fragment := range ca.malformed {
+		emit(Finding{
+			Severity:      severityWarn,
+			RuleID:        "ccadb_disclosure_malformed",
+			CAOwner:       ca.owner,
+			CAFingerprint: ca.fingerprint,
+			Stores:        ca.storeList(),
+			TrustBits:     ca.trustBits,
+			IssuerDN:      ca.subject,
+			Message:       fmt.Sprintf("malformed CCADB disclosure for %s: partitioned CRL entry is not a URL", ca.name()),
+			Evidence:      map[string]string{"column": fieldPartitioned, "fragment": fragment},
+		})
+	}
+}
+
+// ccadbReport is a parsed CCADB CSV report.
+type ccadbReport struct {
+	index   map[string]int
+	records [][]string
+}
+
+// loadCCADBReport reads the named CCADB report from file if one is given and
+// downloads it from url otherwise. A downloaded report that parses is cached,
+// and the cached copy is used when a later download fails.
+func loadCCADBReport(name, file, url string, required ...string) (*ccadbReport, error) {
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		return parseCCADBReport(data, required)
+	}
+
+	cache := filepath.Join(ccadbCacheDir, name+".csv")
+	report, err := downloadCCADBReport(url, cache, required)
+	if err == nil {
+		return report, nil
+	}
+
+	data, cacheErr := os.ReadFile(cache)
+	if cacheErr != nil {
+		return nil, err
+	}
+	cached, cacheErr := parseCCADBReport(data, required)
+	if cacheErr != nil {
+		return nil, err
+	}
+	if info, statErr := os.Stat(cache); statErr == nil {
+		logf("Download of the CCADB %s report failed: %v. Using the cached copy from %s.\n", name, err, info.ModTime().UTC().Format("2006-01-02 15:04:05 MST"))
+	}
+	return cached, nil
+}
+
+func downloadCCADBReport(url, cache string, required []string) (*ccadbReport, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, body, _, err := fetch(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: unexpected status %d", url, resp.StatusCode)
+	}
+	report, err := parseCCADBReport(body, required)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(ccadbCacheDir, 0755); err != nil {
+		logln("Failed to create CCADB cache:", err)
+	} else if err := writeFileAtomic(cache, body); err != nil {
+		logln("Failed to cache CCADB report:", err)
+	}
+	return report, nil
+}
+
+// parseCCADBReport reads the CSV header and all rows. Rows that do not parse
+// are skipped, a report without the required columns is rejected.
+func parseCCADBReport(data []byte, required []string) (*ccadbReport, error) {
+	reader := csv.NewReader(bytes.NewReader(data))
+	headers, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("parsing CSV headers: %w", err)
+	}
+
+	// Map header names to indices
+	report := &ccadbReport{index: map[string]int{}}
+	for i, h := range headers {
+		report.index[strings.TrimSpace(h)] = i
+	}
+	for _, f := range required {
+		if _, ok := columnIndex(report.index, f); !ok {
+			return nil, fmt.Errorf("missing required field in csv: %s", f)
+		}
+	}
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			logf("Skipping row due to error: %v\n", err)
+			continue
+		}
+		report.records = append(report.records, record)
+	}
+	return report, nil
+}
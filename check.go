@@ -1,26 +1,45 @@
 package main
 
 import (
+	"bytes"
+	"cmp"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
+	"sync"
 	"time"
 )
 
-var intermediates []*x509.Certificate
+var (
+	issuerCerts []*x509.Certificate
+	// crlFiles is the manifest of the CRLs below outputBaseDir.
+	crlFiles *crlManifest
+)
 
-func check() {
-	baseDir := "crls"
+// check validates every CRL below outputBaseDir and returns the number of
+// problems found. An error means the check itself could not be completed.
+func check() (problems int, err error) {
+	baseDir := outputBaseDir
 	var totalSize int64
 	var totalRevoces int
-	var err error
+	before := findingCount()
+	defer func() { problems = findingCount() - before }()
+
+	if err := setupLinting(); err != nil {
+		return 0, fmt.Errorf("invalid lint selection: %w", err)
+	}
 
-	intermediates, err = loadIntermediates()
+	issuerCerts, err = loadIssuers()
 	if err != nil {
-		fmt.Println("  LINT: unable to load intermediates File:", err)
-		fmt.Println("  LINT: Skipping signature validation")
+		logln("  LINT: unable to load issuer certificates:", err)
+		logln("  LINT: Skipping signature validation")
+	}
+	if crlFiles, err = loadManifest(); err != nil {
+		logln("Unable to read the CRL manifest:", err)
 	}
 
 	err = filepath.Walk(baseDir, func(path string, info os.FileInfo, err error) error {
@@ -32,134 +51,274 @@ func check() {
 		}
 
 		if *debugLogging {
-			fmt.Printf("CRL: %s\n", path)
+			logf("CRL: %s\n", path)
 		}
 
 		size := info.Size()
 		totalSize += size
 		if *debugLogging {
-			fmt.Printf("  Size: %d bytes\n", size)
+			logf("  Size: %d bytes\n", size)
 		}
 		data, err := os.ReadFile(path)
 		if err != nil {
-			fmt.Println("  Read error:", err)
+			logln("  Read error:", err)
 			return nil
 		}
 
+		ctx := newCRLContext(path)
+		defer func() { recordChecked(ctx) }()
+
 		// If the File is empty, remove it.
 		if len(data) == 0 {
-			fmt.Println("  Read error: File empyt:", path)
+			logln("  Read error: File empyt:", path)
 			err := os.Remove(path)
 			if err != nil {
-				fmt.Printf("  Failed to remove File: %s error: %s\n", path, err)
+				logf("  Failed to remove File: %s error: %s\n", path, err)
 				return err
 			}
 		}
 
-		// If CRL is PEM-encoded we need to strip headers
-		if block, _ := pem.Decode(data); block != nil {
-			if block.Type == "X509 CRL" {
-				data = block.Bytes
-			}
-		}
-
 		// Parse downloaded CRL
-		crl, err := x509.ParseRevocationList(data)
+		data, crl, err := parseCRL(data)
 		if err != nil {
-			fmt.Printf("CRL: %s\n", path)
-			fmt.Printf("  Parse error: %v\n\n", err)
+			emit(ctx.finding(severityError, "crl_parse_error", "unable to parse CRL: "+err.Error(), nil))
 			return nil
 		}
+		ctx.setCRL(crl)
 
 		// Skip signature validation if no issuers are loaded.
-		if intermediates != nil {
-			// find the issuing CA cert
-			var issuer *x509.Certificate
-			for _, ic := range intermediates {
-				if ic.Subject.String() == crl.Issuer.String() {
-					issuer = ic
-					err = crl.CheckSignatureFrom(issuer)
-					if err != nil {
-						fmt.Println("  LINT: unable to verify Signature of", path, " CRL. Err:", err)
-						break
-					}
-					break
-				}
-			}
-			if issuer == nil {
-				fmt.Println("issuer not found among intermediates:", crl.Issuer.String())
+		var issuers []*x509.Certificate
+		if issuerCerts != nil {
+			var found bool
+			issuers, found = verifyCRLSignature(&ctx, crl)
+			if !found {
 				return nil
 			}
 		}
 
+		subscriberCRL, scopeReason := crlScope(crl, issuers)
+		if *debugLogging {
+			logf("  Subscriber CRL: %t (%s)\n", subscriberCRL, scopeReason)
+		}
+
 		// do it after the first parsing.
-		linting(data)
+		linting(data, subscriberCRL, ctx)
 
 		signatureAlgorithm := crl.SignatureAlgorithm
 		if *debugLogging {
-			fmt.Printf("  Signature Algorithm: %s\n", signatureAlgorithm)
+			logf("  Signature Algorithm: %s\n", signatureAlgorithm)
 		}
 
 		issuerName := crl.Issuer
 		if *debugLogging {
-			fmt.Printf("  Issuer: %s\n", issuerName)
+			logf("  Issuer: %s\n", issuerName)
 		}
 		now := time.Now()
 		next := crl.NextUpdate
 		if *debugLogging {
-			fmt.Printf("  NextUpdate: %s\n", next.Format(time.RFC3339))
+			logf("  NextUpdate: %s\n", next.Format(time.RFC3339))
 		}
 
 		if now.After(next) {
 			// AUDIT
 			// If we updated the CRL and it is still expired this is a CAB violation.
-			fmt.Printf("  → CRL %s is expired as of now (%s)\n", path, next)
+			emit(ctx.finding(severityError, "crl_expired", fmt.Sprintf("CRL is expired as of now (%s)", next), map[string]string{
+				"nextUpdate": next.Format(time.RFC3339),
+				"thisUpdate": crl.ThisUpdate.Format(time.RFC3339),
+			}))
 		} else {
 			if *debugLogging {
-				fmt.Printf("  → CRL is still valid\n")
+				logf("  → CRL is still valid\n")
 			}
 		}
 
-		// Counting revoked certificates
+		// Custom sources tell us how often the CA should publish.
+		if ctx.cadence > 0 && now.Sub(crl.ThisUpdate) > ctx.cadence {
+			emit(ctx.finding(severityWarn, "crl_cadence_missed", fmt.Sprintf("no new CRL published within the expected cadence of %s", ctx.cadence), map[string]string{
+				"cadence":    ctx.cadence.String(),
+				"thisUpdate": crl.ThisUpdate.Format(time.RFC3339),
+			}))
+		}
+
+		// Counting revoked certificates, a delta CRL only adds to its complete CRL.
 		revCount := len(crl.RevokedCertificateEntries)
+		if isDeltaCRL(crl) {
+			revCount = checkDelta(ctx, path, crl)
+		}
 		if *debugLogging {
-			fmt.Printf("  Revoked entries: %d\n\n", revCount)
+			logf("  Revoked entries: %d\n\n", revCount)
 		}
 		totalRevoces = totalRevoces + revCount
 
 		return nil
 	})
 	if err != nil {
-		fmt.Printf("Error walking directory: %v\n", err)
-		return
+		return 0, fmt.Errorf("error walking directory: %w", err)
+	}
+
+	logln("Validated all CRL Files.")
+	logf("Total diskspace used by CRLs: %.2f MB\n", float64(totalSize)/(1024*1024))
+	logf("Total revocations: %d\n", totalRevoces)
+	logf("Problems found: %d\n", findingCount()-before)
+	return 0, nil
+}
+
+// crlContext is what we know about a CRL file when reporting findings on it.
+type crlContext struct {
+	path          string
+	url           string
+	issuerDN      string
+	aki           string
+	caFingerprint string
+	caOwner       string
+	stores        []string
+	trustBits     string
+	cadence       time.Duration
+}
+
+// newCRLContext looks up the CA record of a CRL file in the manifest and
+// falls back to the download metadata for files the manifest does not know.
+func newCRLContext(path string) crlContext {
+	ctx := crlContext{path: path}
+	if entry, ok := crlFiles.lookup(path); ok {
+		ctx.url = entry.URL
+		ctx.caFingerprint = entry.CAFingerprint
+		ctx.caOwner = entry.CAOwner
+		ctx.stores = entry.Stores
+		ctx.trustBits = entry.TrustBits
+		ctx.cadence = entry.Cadence
+		return ctx
+	}
+	if meta, err := loadMeta(path); err == nil {
+		ctx.url = meta.URL
+		ctx.cadence = meta.Cadence
+	}
+	return ctx
+}
+
+func (c *crlContext) setCRL(crl *x509.RevocationList) {
+	c.issuerDN = crl.Issuer.String()
+	c.aki = fmt.Sprintf("%X", crl.AuthorityKeyId)
+}
+
+// setIssuer fills in what the manifest did not tell us from the issuer store.
+func (c *crlContext) setIssuer(issuer *x509.Certificate) {
+	c.caFingerprint = cmp.Or(c.caFingerprint, certFingerprint(issuer.Raw))
+	if rec, ok := lookupIssuerRecord(issuer); ok {
+		c.caOwner = cmp.Or(c.caOwner, rec.CAOwner)
+		if c.stores == nil {
+			c.stores = rec.Stores
+		}
 	}
+}
 
-	fmt.Println("Validated all CRL Files.")
-	fmt.Printf("Total diskspace used by CRLs: %.2f MB\n", float64(totalSize)/(1024*1024))
-	fmt.Printf("Total revocations: %d\n", totalRevoces)
+func (c crlContext) finding(severity, rule, message string, evidence map[string]string) Finding {
+	return Finding{
+		Severity:      severity,
+		RuleID:        rule,
+		CAOwner:       c.caOwner,
+		CAFingerprint: c.caFingerprint,
+		Stores:        c.stores,
+		TrustBits:     c.trustBits,
+		IssuerDN:      c.issuerDN,
+		AKI:           c.aki,
+		CRLURL:        c.url,
+		Path:          c.path,
+		Message:       message,
+		Evidence:      evidence,
+	}
 }
 
-func loadIntermediates() ([]*x509.Certificate, error) {
-	data, err := os.ReadFile(intermediatesFile)
+// verifyCRLSignature looks up the issuer of the CRL and verifies its signature.
+// issuers are all certificates that verify it, e.g. a root and its
+// cross-signed twin, the most likely issuer first. found is false if no
+// certificate could have issued the CRL.
+func verifyCRLSignature(ctx *crlContext, crl *x509.RevocationList) (issuers []*x509.Certificate, found bool) {
+	candidates := issuerCandidates(crl)
+	// The CA the CRL was downloaded for is the most likely issuer.
+	if i := slices.IndexFunc(candidates, func(c *x509.Certificate) bool { return certFingerprint(c.Raw) == ctx.caFingerprint }); i > 0 {
+		candidates[0], candidates[i] = candidates[i], candidates[0]
+	}
+	if len(candidates) == 0 {
+		emit(ctx.finding(severityError, "crl_issuer_unknown", "issuer not found among issuer certificates", nil))
+		return nil, false
+	}
+	issuers, err := verifyIssuers(crl, candidates)
 	if err != nil {
-		return nil, err
+		// Attribute the finding to the CA that most likely issued the CRL.
+		ctx.setIssuer(candidates[0])
+		emit(ctx.finding(severityError, "crl_signature_invalid", "unable to verify signature", map[string]string{
+			"candidates": fmt.Sprint(len(candidates)),
+			"error":      err.Error(),
+		}))
+		return nil, true
 	}
+	ctx.setIssuer(issuers[0])
+	return issuers, true
+}
 
-	for {
-		var block *pem.Block
-		block, data = pem.Decode(data)
-		if block == nil {
-			break
+// parseCRL parses a DER or PEM encoded CRL and returns it along with its DER encoding.
+func parseCRL(data []byte) ([]byte, *x509.RevocationList, error) {
+	// If CRL is PEM-encoded we need to strip headers
+	if block, _ := pem.Decode(data); block != nil {
+		if block.Type == "X509 CRL" {
+			data = block.Bytes
 		}
-		if block.Type != "CERTIFICATE" {
-			continue
+	}
+	crl, err := x509.ParseRevocationList(data)
+	return data, crl, err
+}
+
+// issuerCandidates returns every loaded certificate that could have issued
+// the CRL. Certificates whose SubjectKeyId matches the AuthorityKeyId of the
+// CRL come first, followed by certificates that only match by name.
+// Cross-signed and re-keyed CAs share a subject, so there can be several.
+func issuerCandidates(crl *x509.RevocationList) []*x509.Certificate {
+	var byKeyID, byName []*x509.Certificate
+	issuerKey := normalizeDN(crl.Issuer.String())
+	for _, ic := range issuerCerts {
+		switch {
+		case len(crl.AuthorityKeyId) > 0 && bytes.Equal(ic.SubjectKeyId, crl.AuthorityKeyId):
+			byKeyID = append(byKeyID, ic)
+		case bytes.Equal(ic.RawSubject, crl.RawIssuer) || subjectKey(ic) == issuerKey:
+			byName = append(byName, ic)
 		}
-		cert, err := x509.ParseCertificate(block.Bytes)
-		if err != nil {
-			return nil, err
+	}
+	return append(byKeyID, byName...)
+}
+
+// subjectKeys caches the normalized subject of the issuer certificates.
+var (
+	subjectKeysMu sync.Mutex
+	subjectKeys   = map[*x509.Certificate]string{}
+)
+
+func subjectKey(c *x509.Certificate) string {
+	subjectKeysMu.Lock()
+	defer subjectKeysMu.Unlock()
+	key, ok := subjectKeys[c]
+	if !ok {
+		key = normalizeDN(c.Subject.String())
+		subjectKeys[c] = key
+	}
+	return key
+}
+
+// verifyIssuers returns the candidates whose key verifies the CRL signature,
+// in candidate order. The error lists why every candidate failed.
+func verifyIssuers(crl *x509.RevocationList, candidates []*x509.Certificate) ([]*x509.Certificate, error) {
+	var verified []*x509.Certificate
+	var errs []error
+	for _, ic := range candidates {
+		err := crl.CheckSignatureFrom(ic)
+		if err == nil {
+			verified = append(verified, ic)
+			continue
 		}
-		intermediates = append(intermediates, cert)
+		errs = append(errs, fmt.Errorf("%s (SKI %x): %w", ic.Subject, ic.SubjectKeyId, err))
+	}
+	if len(verified) == 0 {
+		return nil, errors.Join(errs...)
 	}
-	fmt.Printf("Loaded %d intermediates.\n", len(intermediates))
-	return intermediates, nil
+	return verified, nil
 }
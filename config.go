@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/pelletier/go-toml"
+)
+
+// defaultConfigFile is read if it exists and no -config is given.
+const defaultConfigFile = "gocrl.toml"
+
+var configFile = new(string)
+
+// configFlags maps the settings of the config file to the flags they set.
+// Flags given on the command line win over the config file.
+var configFlags = map[string]string{
+	"debug":                    "debug",
+	"http.timeout":             "timeout",
+	"http.workers":             "workers",
+	"http.per_host":            "per-host",
+	"http.retries":             "retries",
+	"http.retry_delay":         "retry-delay",
+	"sources.stores":           "stores",
+	"sources.custom":           "sources",
+	"sources.ccadb_url":        "ccadb-url",
+	"sources.ccadb_file":       "ccadb-file",
+	"sources.ccadb_roots_url":  "ccadb-roots-url",
+	"sources.ccadb_roots_file": "ccadb-roots-file",
+	"sources.ccadb_all_url":    "ccadb-all-url",
+	"sources.ccadb_all_file":   "ccadb-all-file",
+	"archive.keep":             "archive-keep",
+	"archive.max_age":          "archive-max-age",
+	"archive.delete_orphans":   "delete-orphans",
+	"lint.include":             "lint-include",
+	"lint.exclude":             "lint-exclude",
+	"lint.include_sources":     "lint-include-sources",
+	"lint.exclude_sources":     "lint-exclude-sources",
+	"lint.min_severity":        "lint-min-severity",
+	"lint.show_errors":         "show-lint-errors",
+	"output.format":            "format",
+	"output.sarif":             "sarif",
+	"output.junit":             "junit",
+	"output.filter_stores":     "filter-stores",
+	"serve.listen":             "listen",
+	"serve.reload":             "reload",
+	"notify.webhook":           "notify-webhook",
+	"report.latency_deadline":  "latency-deadline",
+}
+
+// configPaths are the settings that have no flag.
+var configPaths = map[string]*string{
+	"paths.crls":          &outputBaseDir,
+	"paths.issuers":       &issuerStoreDir,
+	"paths.intermediates": &intermediatesFile,
+	"paths.archive":       &archiveDir,
+	"paths.quarantine":    &quarantineDir,
+	"paths.ccadb_cache":   &ccadbCacheDir,
+}
+
+// applyConfig reads the config file and sets every flag of fs that was not
+// given on the command line. A missing default config file is not an error.
+func applyConfig(fs *flag.FlagSet) error {
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	tree, err := toml.LoadFile(*configFile)
+	if err != nil {
+		if os.IsNotExist(err) && !set["config"] {
+			return nil
+		}
+		return err
+	}
+
+	var errs []error
+	for _, key := range configKeys(tree, "") {
+		name, isFlag := configFlags[key]
+		path, isPath := configPaths[key]
+		switch {
+		case isFlag:
+			if set[name] || fs.Lookup(name) == nil {
+				continue
+			}
+			if err := fs.Set(name, configValue(tree.Get(key))); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", key, err))
+			}
+		case isPath:
+			value, ok := tree.Get(key).(string)
+			if !ok || value == "" {
+				errs = append(errs, fmt.Errorf("%s: must be a non-empty string", key))
+				continue
+			}
+			*path = value
+		default:
+			errs = append(errs, fmt.Errorf("%s: unknown setting", key))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("%s:\n%w", *configFile, err)
+	}
+	return nil
+}
+
+// configKeys returns the dotted keys of all values in the tree.
+func configKeys(tree *toml.Tree, prefix string) []string {
+	var keys []string
+	for _, k := range tree.Keys() {
+		if sub, ok := tree.GetPath([]string{k}).(*toml.Tree); ok {
+			keys = append(keys, configKeys(sub, prefix+k+".")...)
+			continue
+		}
+		keys = append(keys, prefix+k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// configValue formats a config value the way it would be given as a flag.
+// Lists become comma separated.
+func configValue(v any) string {
+	if list, ok := v.([]any); ok {
+		items := make([]string, len(list))
+		for i, item := range list {
+			items[i] = fmt.Sprint(item)
+		}
+		return strings.Join(items, ",")
+	}
+	return fmt.Sprint(v)
+}
+
+// configCommandFlags registers every flag that can be set in the config file.
+func configCommandFlags(fs *flag.FlagSet) {
+	updateFlags(fs)
+	checkFlags(fs)
+	serveFlags(fs)
+	latencyFlags(fs)
+}
+
+// configCommand validates the config file. applyConfig has already checked
+// that every setting is known and has a valid value.
+func configCommand(fs *flag.FlagSet) int {
+	if fs.NArg() != 1 || fs.Arg(0) != "validate" {
+		fs.Usage()
+		return exitUsage
+	}
+
+	if _, err := os.Stat(*configFile); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+
+	var errs []error
+	if _, err := parseStores(*updateStores); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := parseStores(*filterStores); err != nil {
+		errs = append(errs, fmt.Errorf("filter-stores: %w", err))
+	}
+	if err := setupLinting(); err != nil {
+		errs = append(errs, fmt.Errorf("lint selection: %w", err))
+	}
+	if *customSources != "" {
+		if _, err := loadCustomCAs(*customSources); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, file := range []string{*ccadbFile, *ccadbRootsFile, *ccadbAllFile} {
+		if file == "" {
+			continue
+		}
+		if _, err := os.Stat(file); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if *workers < 1 || *perHostLimit < 1 {
+		errs = append(errs, fmt.Errorf("workers and per-host must be at least 1"))
+	}
+	if *retries < 0 || *retryDelay < 0 || *clientTimeout <= 0 || *archiveKeep < 0 || *archiveMaxAge < 0 || *serveReload < 0 || *latencyDeadline < 0 {
+		errs = append(errs, fmt.Errorf("retries, retry-delay, archive-keep, archive-max-age, reload and latency-deadline must not be negative, timeout must be positive"))
+	}
+	if *notifyWebhook != "" {
+		if u, err := url.Parse(*notifyWebhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			errs = append(errs, fmt.Errorf("notify webhook %q is not an http(s) URL", *notifyWebhook))
+		}
+	}
+
+	if len(errs) > 0 {
+		for _, err := range errs {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		return exitUsage
+	}
+	fmt.Println("Configuration", *configFile, "is valid.")
+	return exitOK
+}
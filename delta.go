@@ -0,0 +1,224 @@
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// deltaProblem returns why delta cannot be applied to the complete CRL base
+// (RFC 5280 section 5.2.4), or "" if it can.
+func deltaProblem(base, delta *x509.RevocationList) string {
+	baseNumber, err := parseDeltaCRLIndicator(delta)
+	switch {
+	case err != nil:
+		return "deltaCRLIndicator is not parsable: " + err.Error()
+	case baseNumber == nil:
+		return "not a delta CRL"
+	case !sameDN(base.Issuer.String(), delta.Issuer.String()):
+		return fmt.Sprintf("issuer %s differs from the complete CRL issuer %s", delta.Issuer, base.Issuer)
+	case !sameScope(base, delta):
+		return "issuingDistributionPoint differs from the one of the complete CRL"
+	case base.Number == nil || delta.Number == nil:
+		return "complete or delta CRL has no CRL number"
+	case base.Number.Cmp(baseNumber) < 0:
+		return fmt.Sprintf("complete CRL number %s is lower than the BaseCRLNumber %s", base.Number, baseNumber)
+	case base.Number.Cmp(delta.Number) >= 0:
+		return fmt.Sprintf("delta CRL number %s is not higher than the complete CRL number %s", delta.Number, base.Number)
+	}
+	return ""
+}
+
+// mergeDelta returns the revocations of a complete CRL updated by one of its
+// delta CRLs: delta entries replace or add to those of the base, entries with
+// reason removeFromCRL take the certificate off the list.
+func mergeDelta(base, delta *x509.RevocationList) []x509.RevocationListEntry {
+	entries := slices.Clone(base.RevokedCertificateEntries)
+	index := make(map[string]int, len(entries))
+	for i, e := range entries {
+		index[e.SerialNumber.String()] = i
+	}
+	removed := map[int]bool{}
+	for _, e := range delta.RevokedCertificateEntries {
+		i, ok := index[e.SerialNumber.String()]
+		switch {
+		case e.ReasonCode == reasonRemoveFromCRL:
+			if ok {
+				removed[i] = true
+			}
+		case ok:
+			entries[i] = e
+			delete(removed, i)
+		default:
+			index[e.SerialNumber.String()] = len(entries)
+			entries = append(entries, e)
+		}
+	}
+
+	merged := entries[:0]
+	for i, e := range entries {
+		if !removed[i] {
+			merged = append(merged, e)
+		}
+	}
+	return merged
+}
+
+// baseCRLFor finds the complete CRL of a delta CRL: the one the manifest
+// names, or else a complete CRL in the same directory it can be applied to.
+func baseCRLFor(path string, delta *x509.RevocationList) (string, *x509.RevocationList) {
+	var candidates []string
+	named := false
+	if entry, ok := crlFiles.lookup(path); ok && entry.DeltaOf != "" {
+		candidates, named = []string{filepath.Join(outputBaseDir, filepath.FromSlash(entry.DeltaOf))}, true
+	} else {
+		candidates, _ = filepath.Glob(filepath.Join(filepath.Dir(path), "*.crl"))
+	}
+	for _, candidate := range candidates {
+		if candidate == path {
+			continue
+		}
+		data, err := os.ReadFile(candidate)
+		if err != nil {
+			continue
+		}
+		_, crl, err := parseCRL(data)
+		if err != nil {
+			continue
+		}
+		if isDeltaCRL(crl) {
+			continue
+		}
+		// The base named by the manifest is returned even if it does not
+		// fit, so check reports why.
+		if named || deltaProblem(crl, delta) == "" {
+			return candidate, crl
+		}
+	}
+	return "", nil
+}
+
+// checkDelta checks a delta CRL against its complete CRL and returns the
+// number of revocations it adds to it.
+func checkDelta(ctx crlContext, path string, crl *x509.RevocationList) int {
+	baseNumber, err := parseDeltaCRLIndicator(crl)
+	if err != nil {
+		emit(ctx.finding(severityError, "crl_delta_indicator_invalid", "unable to parse the deltaCRLIndicator: "+err.Error(), nil))
+		return len(crl.RevokedCertificateEntries)
+	}
+	if *debugLogging {
+		logf("  Delta CRL of base CRL number: %s\n", baseNumber)
+	}
+
+	basePath, base := baseCRLFor(path, crl)
+	if base == nil {
+		emit(ctx.finding(severityWarn, "crl_delta_base_missing", "no complete CRL found for this delta CRL", map[string]string{
+			"baseCRLNumber": baseNumber.String(),
+		}))
+		return len(crl.RevokedCertificateEntries)
+	}
+	if problem := deltaProblem(base, crl); problem != "" {
+		evidence := map[string]string{"baseCRL": basePath, "baseCRLNumber": baseNumber.String()}
+		if base.Number != nil {
+			evidence["completeCRLNumber"] = base.Number.String()
+		}
+		if crl.Number != nil {
+			evidence["deltaCRLNumber"] = crl.Number.String()
+		}
+		emit(ctx.finding(severityError, "crl_delta_base_mismatch", "delta CRL cannot be applied to its complete CRL: "+problem, evidence))
+		return len(crl.RevokedCertificateEntries)
+	}
+	if *debugLogging {
+		logf("  Complete CRL: %s (CRL number %s)\n", basePath, base.Number)
+	}
+	return len(mergeDelta(base, crl)) - len(base.RevokedCertificateEntries)
+}
+
+// pairDeltas attaches every delta CRL to the complete CRL it applies to and
+// sets the merged revocations. Of several deltas of one CRL the newest wins.
+// Deltas without a complete CRL stay on their own.
+func pairDeltas(crls []localCRL) []localCRL {
+	var complete, deltas []localCRL
+	for _, c := range crls {
+		if isDeltaCRL(c.CRL) {
+			deltas = append(deltas, c)
+		} else {
+			complete = append(complete, c)
+		}
+	}
+
+	for _, d := range deltas {
+		attached := false
+		for i := range complete {
+			c := &complete[i]
+			if deltaProblem(c.CRL, d.CRL) != "" {
+				continue
+			}
+			attached = true
+			if c.Delta == nil || c.Delta.Number.Cmp(d.CRL.Number) < 0 {
+				c.DeltaPath, c.Delta = d.Path, d.CRL
+			}
+		}
+		if !attached {
+			complete = append(complete, d)
+		}
+	}
+
+	for i := range complete {
+		c := &complete[i]
+		c.Entries = c.CRL.RevokedCertificateEntries
+		if c.Delta != nil {
+			c.Entries = mergeDelta(c.CRL, c.Delta)
+		}
+	}
+	return complete
+}
+
+// planDeltaCRLs adds the delta CRLs named by the freshestCRL extension of the
+// downloaded complete CRLs to the manifest and returns the jobs to fetch them.
+func planDeltaCRLs(m *crlManifest) []job {
+	m.mu.Lock()
+	files := maps.Clone(m.Files)
+	m.mu.Unlock()
+
+	var jobs []job
+	for _, rel := range slices.Sorted(maps.Keys(files)) {
+		entry := files[rel]
+		if entry.DeltaOf != "" || entry.SameAs != "" {
+			continue
+		}
+		path := filepath.Join(outputBaseDir, filepath.FromSlash(rel))
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		_, crl, err := parseCRL(data)
+		if err != nil {
+			continue
+		}
+		urls, err := parseFreshestCRL(crl)
+		if err != nil {
+			logln("Unable to parse freshestCRL of", entry.URL, "error:", err)
+			continue
+		}
+		for _, url := range urls {
+			if !validCRLURL(url) {
+				logln("Skipping delta CRL of", entry.URL, "with unsupported URL", url)
+				continue
+			}
+			dest := filepath.Join(filepath.Dir(path), crlFileName(url))
+			if _, ok := m.lookup(dest); ok {
+				continue
+			}
+			delta := entry
+			delta.URL = cleanURL(url)
+			delta.DeltaOf = rel
+			m.add(dest, delta)
+			jobs = append(jobs, crlJob(url, dest, entry.Cadence))
+		}
+	}
+	return jobs
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"encoding/asn1"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+	"unicode/utf16"
+)
+
+// dnAttribute is one attribute type and value of a distinguished name.
+type dnAttribute struct {
+	Type  string
+	Value string
+}
+
+// distinguishedName is a parsed DN: its RDNs in the order they were written,
+// each with one or more attributes (multi-valued RDNs are joined by '+').
+type distinguishedName [][]dnAttribute
+
+// dnTypes maps OIDs and alternative spellings to the usual attribute keyword.
+var dnTypes = map[string]string{
+	"2.5.4.3":                    "CN",
+	"2.5.4.5":                    "SERIALNUMBER",
+	"2.5.4.6":                    "C",
+	"2.5.4.7":                    "L",
+	"2.5.4.8":                    "ST",
+	"S":                          "ST",
+	"2.5.4.9":                    "STREET",
+	"2.5.4.10":                   "O",
+	"2.5.4.11":                   "OU",
+	"2.5.4.17":                   "POSTALCODE",
+	"2.5.4.97":                   "ORGANIZATIONIDENTIFIER",
+	"0.9.2342.19200300.100.1.25": "DC",
+	"1.2.840.113549.1.9.1":       "EMAILADDRESS",
+	"E":                          "EMAILADDRESS",
+	"EMAIL":                      "EMAILADDRESS",
+}
+
+// parseDN parses a distinguished name as written by RFC 4514 and by CCADB,
+// which separates RDNs with ';' instead of ','. A DN with an unescaped ';' is
+// taken to use it as separator, ',' is then part of the values. Values may be
+// quoted or contain escaped special characters and hex pairs.
+func parseDN(s string) (distinguishedName, error) {
+	var dn distinguishedName
+	var rdn []dnAttribute
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	// Trailing spaces are left to parseDNValue, they may be escaped.
+	s = strings.TrimRight(strings.TrimLeft(s, " \t\r\n"), "\t\r\n")
+	sep := rdnSeparator(s)
+
+	for i := 0; i < len(s); {
+		// Attribute type
+		eq := strings.IndexByte(s[i:], '=')
+		if eq < 0 {
+			return nil, fmt.Errorf("missing '=' after %q", s[i:])
+		}
+		typ := strings.ToUpper(strings.TrimSpace(s[i : i+eq]))
+		if typ == "" {
+			return nil, fmt.Errorf("empty attribute type at offset %d", i)
+		}
+		typ = strings.TrimPrefix(typ, "OID.")
+		if !validDNType(typ) {
+			return nil, fmt.Errorf("invalid attribute type %q at offset %d", typ, i)
+		}
+		if canonical, ok := dnTypes[typ]; ok {
+			typ = canonical
+		}
+		i += eq + 1
+
+		// Attribute value
+		for i < len(s) && s[i] == ' ' {
+			i++
+		}
+		value, n, err := parseDNValue(s[i:], sep)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", typ, err)
+		}
+		i += n
+		rdn = append(rdn, dnAttribute{Type: typ, Value: value})
+
+		if i < len(s) {
+			switch s[i] {
+			case '+':
+			case sep:
+				dn = append(dn, rdn)
+				rdn = nil
+			default:
+				return nil, fmt.Errorf("unexpected %q at offset %d", s[i], i)
+			}
+			i++
+			for i < len(s) && s[i] == ' ' {
+				i++
+			}
+		}
+	}
+	if len(rdn) == 0 {
+		return nil, fmt.Errorf("trailing separator")
+	}
+	return append(dn, rdn), nil
+}
+
+// rdnSeparator returns ';' if s has a ';' that is neither escaped nor quoted,
+// and ',' otherwise.
+func rdnSeparator(s string) byte {
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			quoted = !quoted
+		case ';':
+			if !quoted {
+				return ';'
+			}
+		}
+	}
+	return ','
+}
+
+// validDNType reports whether typ is a keyword (a letter followed by
+// letters, digits and hyphens) or a dotted numeric OID.
+func validDNType(typ string) bool {
+	if typ[0] >= '0' && typ[0] <= '9' {
+		for _, arc := range strings.Split(typ, ".") {
+			if arc == "" || strings.Trim(arc, "0123456789") != "" || len(arc) > 1 && arc[0] == '0' {
+				return false
+			}
+		}
+		return true
+	}
+	for i := 0; i < len(typ); i++ {
+		c := typ[i]
+		if !('A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || i > 0 && ('0' <= c && c <= '9' || c == '-')) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseDNValue reads a value up to the next unescaped '+' or RDN separator
+// sep and returns the value and the number of bytes consumed.
+func parseDNValue(s string, sep byte) (string, int, error) {
+	if strings.HasPrefix(s, "#") {
+		if value, n, ok := parseDNHexValue(s, sep); ok {
+			return value, n, nil
+		}
+	}
+	if strings.HasPrefix(s, `"`) {
+		var b strings.Builder
+		for i := 1; i < len(s); i++ {
+			switch s[i] {
+			case '\\':
+				if i+1 < len(s) {
+					i++
+					b.WriteByte(s[i])
+				}
+			case '"':
+				// Skip spaces up to the separator.
+				j := i + 1
+				for j < len(s) && s[j] == ' ' {
+					j++
+				}
+				return b.String(), j, nil
+			default:
+				b.WriteByte(s[i])
+			}
+		}
+		return "", 0, fmt.Errorf("unterminated quoted value")
+	}
+
+	var b []byte
+	// Trailing spaces are only part of the value when escaped.
+	keep := 0
+	i := 0
+	for ; i < len(s); i++ {
+		c := s[i]
+		if c == sep || c == '+' {
+			break
+		}
+		if c != '\\' {
+			b = append(b, c)
+			if c != ' ' {
+				keep = len(b)
+			}
+			continue
+		}
+		if i+1 >= len(s) {
+			return "", 0, fmt.Errorf("dangling escape")
+		}
+		if i+2 < len(s) && isHex(s[i+1]) && isHex(s[i+2]) {
+			v, _ := hex.DecodeString(s[i+1 : i+3])
+			b = append(b, v...)
+			i += 2
+		} else {
+			b = append(b, s[i+1])
+			i++
+		}
+		keep = len(b)
+	}
+	return string(b[:keep]), i, nil
+}
+
+// parseDNHexValue decodes a value written as '#' and the hex of its BER
+// encoding (RFC 4514 section 2.4), which is used for attribute types without
+// a string representation, e.g. an organizationIdentifier given by OID. ok is
+// false if s is no such value, CCADB may write a literal '#'.
+func parseDNHexValue(s string, sep byte) (value string, n int, ok bool) {
+	end := 1
+	for end < len(s) && isHex(s[end]) {
+		end++
+	}
+	n = end
+	for n < len(s) && s[n] == ' ' {
+		n++
+	}
+	if n < len(s) && s[n] != sep && s[n] != '+' {
+		return "", 0, false
+	}
+	der, err := hex.DecodeString(s[1:end])
+	if err != nil {
+		return "", 0, false
+	}
+	var raw asn1.RawValue
+	if rest, err := asn1.Unmarshal(der, &raw); err != nil || len(rest) > 0 || raw.Class != asn1.ClassUniversal {
+		return "", 0, false
+	}
+	switch raw.Tag {
+	case asn1.TagUTF8String, asn1.TagPrintableString, asn1.TagIA5String, asn1.TagT61String, asn1.TagNumericString:
+		return string(raw.Bytes), n, true
+	case asn1.TagBMPString:
+		if len(raw.Bytes)%2 != 0 {
+			return "", 0, false
+		}
+		units := make([]uint16, len(raw.Bytes)/2)
+		for i := range units {
+			units[i] = uint16(raw.Bytes[2*i])<<8 | uint16(raw.Bytes[2*i+1])
+		}
+		return string(utf16.Decode(units)), n, true
+	}
+	// Not a string, compare the encoding.
+	return "#" + strings.ToLower(s[1:end]), n, true
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+// get returns the first value of an attribute, e.g. get("CN").
+func (dn distinguishedName) get(typ string) string {
+	for _, rdn := range dn {
+		for _, attr := range rdn {
+			if attr.Type == typ {
+				return attr.Value
+			}
+		}
+	}
+	return ""
+}
+
+// normalized returns a form of the DN for comparisons: canonical attribute
+// types, values case folded with whitespace collapsed, and the attributes of
+// multi-valued RDNs sorted.
+func (dn distinguishedName) normalized() string {
+	rdns := make([]string, len(dn))
+	for i, rdn := range dn {
+		attrs := make([]string, len(rdn))
+		for j, attr := range rdn {
+			value := strings.ToLower(strings.Join(strings.Fields(attr.Value), " "))
+			attrs[j] = attr.Type + "=" + dnEscaper.Replace(value)
+		}
+		slices.Sort(attrs)
+		rdns[i] = strings.Join(attrs, "+")
+	}
+	return strings.Join(rdns, ",")
+}
+
+// dnEscaper escapes the characters that separate attributes and RDNs, so
+// normalized DNs of different structure never compare equal.
+var dnEscaper = strings.NewReplacer(`\`, `\\`, `,`, `\,`, `+`, `\+`, `;`, `\;`, `"`, `\"`)
+
+// normalizeDN returns the normalized form of a DN string, or the trimmed
+// string itself if it does not parse.
+func normalizeDN(s string) string {
+	dn, err := parseDN(s)
+	if err != nil {
+		return strings.TrimSpace(s)
+	}
+	return dn.normalized()
+}
+
+// sameDN reports whether two DN strings name the same entity.
+func sameDN(a, b string) bool {
+	return normalizeDN(a) == normalizeDN(b)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseDN(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want distinguishedName
+	}{
+		{
+			name: "RFC 4514",
+			in:   "CN=Example CA,O=Example Inc.,C=US",
+			want: distinguishedName{{{"CN", "Example CA"}}, {{"O", "Example Inc."}}, {{"C", "US"}}},
+		},
+		{
+			name: "escaped",
+			in:   `CN=Example\, Inc. CA,O=A\+B\;C,OU=\23hash\20`,
+			want: distinguishedName{{{"CN", "Example, Inc. CA"}}, {{"O", "A+B;C"}}, {{"OU", "#hash "}}},
+		},
+		{
+			name: "quoted",
+			in:   `CN="Example, Inc. CA" , O="say \"hi\"; bye"`,
+			want: distinguishedName{{{"CN", "Example, Inc. CA"}}, {{"O", `say "hi"; bye`}}},
+		},
+		{
+			name: "multi-valued",
+			in:   "CN=Example CA+SERIALNUMBER=42,O=Example",
+			want: distinguishedName{{{"CN", "Example CA"}, {"SERIALNUMBER", "42"}}, {{"O", "Example"}}},
+		},
+		{
+			name: "types",
+			in:   "2.5.4.3=Example CA, OID.2.5.4.10=Example, s=Bavaria, E=ca@example.com",
+			want: distinguishedName{{{"CN", "Example CA"}}, {{"O", "Example"}}, {{"ST", "Bavaria"}}, {{"EMAILADDRESS", "ca@example.com"}}},
+		},
+		{
+			name: "CCADB",
+			in:   "CN=Example CA; O=Example, Inc.; C=US",
+			want: distinguishedName{{{"CN", "Example CA"}}, {{"O", "Example, Inc."}}, {{"C", "US"}}},
+		},
+		{
+			name: "CCADB with comma before the first separator",
+			in:   "OU=(c) 2012 Entrust, Inc. - for authorized use only; O=Entrust, Inc.; C=US",
+			want: distinguishedName{{{"OU", "(c) 2012 Entrust, Inc. - for authorized use only"}}, {{"O", "Entrust, Inc."}}, {{"C", "US"}}},
+		},
+		{
+			name: "quoted semicolon",
+			in:   `CN="a; b",O=Example`,
+			want: distinguishedName{{{"CN", "a; b"}}, {{"O", "Example"}}},
+		},
+		{
+			name: "BER encoded",
+			in:   "CN=Example CA,2.5.4.97=#0c0f56415444452d313233343536373839 + 2.5.4.5=#1e0e00dc006e00ef0063006f00640065,OU=#0101ff",
+			want: distinguishedName{{{"CN", "Example CA"}}, {{"ORGANIZATIONIDENTIFIER", "VATDE-123456789"}, {"SERIALNUMBER", "Ünïcode"}}, {{"OU", "#0101ff"}}},
+		},
+		{
+			name: "CCADB literal hash",
+			in:   "CN=#1 CA; O=Example",
+			want: distinguishedName{{{"CN", "#1 CA"}}, {{"O", "Example"}}},
+		},
+		{
+			name: "empty",
+			in:   "  ",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseDN(tt.in)
+			if err != nil {
+				t.Fatalf("parseDN(%q): %v", tt.in, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseDN(%q) = %v, want %v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseDNErrors(t *testing.T) {
+	tests := []string{
+		"OU=(c) 2012 Entrust, Inc. - for authorized use only, O=Entrust",
+		"CN=Example,",
+		"CN=Example,O",
+		"=Example",
+		"1.2.=Example",
+		"CN=\"Example",
+		`CN=Example\`,
+	}
+	for _, in := range tests {
+		if dn, err := parseDN(in); err == nil {
+			t.Errorf("parseDN(%q) = %v, want error", in, dn)
+		}
+	}
+}
+
+func TestSameDN(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"CN=Example CA; O=Example, Inc.; C=US", "CN=example  ca,O=Example\\, Inc.,C=US", true},
+		{"CN=Example CA+2.5.4.5=42", "serialNumber=42 + cn=Example CA", true},
+		{"CN=Example CA,O=Example", "CN=Example CA+O=Example", false},
+		{"CN=a\\,b", "CN=a,CN=b", false},
+		{"CN=Example CA; organizationIdentifier=VATDE-123456789", "CN=Example CA,2.5.4.97=#0c0f56415444452d313233343536373839", true},
+	}
+	for _, tt := range tests {
+		if got := sameDN(tt.a, tt.b); got != tt.want {
+			t.Errorf("sameDN(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
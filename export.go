@@ -0,0 +1,266 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	sarifSchema  = "https://json.schemastore.org/sarif-2.1.0.json"
+	toolInfoURI  = "https://github.com/Knight1/Gocrl"
+	generalCase  = "general"
+	junitSuiteID = "Gocrl CRL compliance"
+)
+
+var (
+	sarifFile = new(string)
+	junitFile = new(string)
+
+	checkedMu   sync.Mutex
+	checkedCRLs []crlContext
+)
+
+// recordChecked remembers a checked CRL, so CRLs without findings show up
+// as passed test cases.
+func recordChecked(ctx crlContext) {
+	checkedMu.Lock()
+	checkedCRLs = append(checkedCRLs, ctx)
+	checkedMu.Unlock()
+}
+
+// writeExports writes the SARIF and JUnit files requested on the command line.
+func writeExports() error {
+	if *sarifFile != "" {
+		if err := writeSARIF(*sarifFile); err != nil {
+			return err
+		}
+	}
+	if *junitFile != "" {
+		if err := writeJUnit(*junitFile); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type sarifLog struct {
+	Version string     `json:"version"`
+	Schema  string     `json:"$schema"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool    sarifTool     `json:"tool"`
+	Results []sarifResult `json:"results"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name           string      `json:"name"`
+	InformationURI string      `json:"informationUri"`
+	Version        string      `json:"version,omitempty"`
+	Rules          []sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+	ID               string       `json:"id"`
+	ShortDescription sarifMessage `json:"shortDescription"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifResult struct {
+	RuleID              string            `json:"ruleId"`
+	Level               string            `json:"level"`
+	Message             sarifMessage      `json:"message"`
+	Locations           []sarifLocation   `json:"locations,omitempty"`
+	PartialFingerprints map[string]string `json:"partialFingerprints"`
+	Properties          map[string]string `json:"properties,omitempty"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation sarifPhysicalLocation `json:"physicalLocation"`
+}
+
+type sarifPhysicalLocation struct {
+	ArtifactLocation sarifArtifactLocation `json:"artifactLocation"`
+}
+
+type sarifArtifactLocation struct {
+	URI string `json:"uri"`
+}
+
+func sarifLevel(severity string) string {
+	switch severity {
+	case severityError, severityFatal:
+		return "error"
+	case severityWarn:
+		return "warning"
+	default:
+		return "note"
+	}
+}
+
+func writeSARIF(path string) error {
+	findingsMu.Lock()
+	list := append([]Finding(nil), findings...)
+	findingsMu.Unlock()
+
+	rules := map[string]string{}
+	results := make([]sarifResult, 0, len(list))
+	for _, f := range list {
+		if desc := f.Evidence["description"]; desc != "" {
+			rules[f.RuleID] = desc
+		} else if _, ok := rules[f.RuleID]; !ok {
+			rules[f.RuleID] = f.RuleID
+		}
+
+		properties := map[string]string{}
+		for k, v := range f.Evidence {
+			properties[k] = v
+		}
+		for k, v := range map[string]string{"severity": f.Severity, "caOwner": f.CAOwner, "caFingerprint": f.CAFingerprint, "stores": strings.Join(f.Stores, ","), "trustBits": f.TrustBits, "issuerDN": f.IssuerDN, "aki": f.AKI, "crlURL": f.CRLURL} {
+			if v != "" {
+				properties[k] = v
+			}
+		}
+
+		// The fingerprint ties a result to the same rule on the same CRL
+		// across runs, so code-scanning UIs can track regressions.
+		sum := sha256.Sum256([]byte(f.RuleID + "\x00" + f.Path + "\x00" + f.CRLURL))
+		result := sarifResult{
+			RuleID:              f.RuleID,
+			Level:               sarifLevel(f.Severity),
+			Message:             sarifMessage{Text: f.Message},
+			PartialFingerprints: map[string]string{"gocrlFinding/v1": hex.EncodeToString(sum[:])},
+			Properties:          properties,
+		}
+		if f.Path != "" {
+			result.Locations = []sarifLocation{{PhysicalLocation: sarifPhysicalLocation{ArtifactLocation: sarifArtifactLocation{URI: f.Path}}}}
+		}
+		results = append(results, result)
+	}
+
+	driver := sarifDriver{Name: "Gocrl", InformationURI: toolInfoURI, Version: CommitHash, Rules: []sarifRule{}}
+	for _, id := range sortedKeys(rules) {
+		driver.Rules = append(driver.Rules, sarifRule{ID: id, ShortDescription: sarifMessage{Text: rules[id]}})
+	}
+
+	data, err := json.MarshalIndent(sarifLog{
+		Version: "2.1.0",
+		Schema:  sarifSchema,
+		Runs:    []sarifRun{{Tool: sarifTool{Driver: driver}, Results: results}},
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Name     string           `xml:"name,attr"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Timestamp string          `xml:"timestamp,attr"`
+	Cases     []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string         `xml:"name,attr"`
+	ClassName string         `xml:"classname,attr"`
+	Failures  []junitFailure `xml:"failure"`
+}
+
+type junitFailure struct {
+	Type    string `xml:"type,attr"`
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// writeJUnit writes one test case per checked CRL with a failure per finding.
+// Findings that do not belong to a CRL file end up in a "general" test case.
+func writeJUnit(path string) error {
+	findingsMu.Lock()
+	list := append([]Finding(nil), findings...)
+	findingsMu.Unlock()
+	checkedMu.Lock()
+	checked := append([]crlContext(nil), checkedCRLs...)
+	checkedMu.Unlock()
+
+	cases := map[string]*junitTestCase{}
+	className := func(owner, issuer string) string {
+		if owner != "" {
+			return owner
+		}
+		if issuer != "" {
+			return issuer
+		}
+		return "Gocrl"
+	}
+	for _, ctx := range checked {
+		cases[ctx.path] = &junitTestCase{Name: ctx.path, ClassName: className(ctx.caOwner, ctx.issuerDN)}
+	}
+
+	suite := junitTestSuite{Name: junitSuiteID, Timestamp: time.Now().UTC().Format(time.RFC3339)}
+	for _, f := range list {
+		name := f.Path
+		if name == "" {
+			name = generalCase
+		}
+		tc, ok := cases[name]
+		if !ok {
+			tc = &junitTestCase{Name: name, ClassName: className(f.CAOwner, f.IssuerDN)}
+			cases[name] = tc
+		}
+		text := f.Message
+		for _, k := range sortedKeys(f.Evidence) {
+			text += "\n" + k + ": " + f.Evidence[k]
+		}
+		tc.Failures = append(tc.Failures, junitFailure{Type: f.RuleID, Message: "[" + f.Severity + "] " + f.Message, Text: text})
+	}
+
+	names := make([]string, 0, len(cases))
+	for name := range cases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		suite.Cases = append(suite.Cases, *cases[name])
+		// JUnit counts failed test cases, not failures.
+		if len(cases[name].Failures) > 0 {
+			suite.Failures++
+		}
+	}
+	suite.Tests = len(suite.Cases)
+
+	data, err := xml.MarshalIndent(junitTestSuites{
+		Name:     "Gocrl",
+		Tests:    suite.Tests,
+		Failures: suite.Failures,
+		Suites:   []junitTestSuite{suite},
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append([]byte(xml.Header), data...), 0644)
+}
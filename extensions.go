@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+var (
+	oidDeltaCRLIndicator        = asn1.ObjectIdentifier{2, 5, 29, 27}
+	oidIssuingDistributionPoint = asn1.ObjectIdentifier{2, 5, 29, 28}
+	oidFreshestCRL              = asn1.ObjectIdentifier{2, 5, 29, 46}
+	oidExpiredCertsOnCRL        = asn1.ObjectIdentifier{2, 5, 29, 60}
+)
+
+// issuingDistributionPoint mirrors the IDP extension of RFC 5280 section 5.2.5.
+type issuingDistributionPoint struct {
+	DistributionPoint          asn1.RawValue  `asn1:"optional,tag:0"`
+	OnlyContainsUserCerts      bool           `asn1:"optional,tag:1"`
+	OnlyContainsCACerts        bool           `asn1:"optional,tag:2"`
+	OnlySomeReasons            asn1.BitString `asn1:"optional,tag:3"`
+	IndirectCRL                bool           `asn1:"optional,tag:4"`
+	OnlyContainsAttributeCerts bool           `asn1:"optional,tag:5"`
+}
+
+// parseIDP returns the issuingDistributionPoint of the CRL or nil if it has none.
+func parseIDP(crl *x509.RevocationList) (*issuingDistributionPoint, error) {
+	for _, ext := range crl.Extensions {
+		if !ext.Id.Equal(oidIssuingDistributionPoint) {
+			continue
+		}
+		var idp issuingDistributionPoint
+		if _, err := asn1.Unmarshal(ext.Value, &idp); err != nil {
+			return nil, err
+		}
+		return &idp, nil
+	}
+	return nil, nil
+}
+
+// idpValue returns the DER of the issuingDistributionPoint extension, which
+// defines the scope of the CRL, or nil if it has none.
+func idpValue(crl *x509.RevocationList) []byte {
+	for _, ext := range crl.Extensions {
+		if ext.Id.Equal(oidIssuingDistributionPoint) {
+			return ext.Value
+		}
+	}
+	return nil
+}
+
+// sameScope reports whether two CRLs have the same issuingDistributionPoint.
+func sameScope(a, b *x509.RevocationList) bool {
+	return bytes.Equal(idpValue(a), idpValue(b))
+}
+
+// isDeltaCRL reports whether the CRL has a deltaCRLIndicator extension.
+func isDeltaCRL(crl *x509.RevocationList) bool {
+	for _, ext := range crl.Extensions {
+		if ext.Id.Equal(oidDeltaCRLIndicator) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseDeltaCRLIndicator returns the BaseCRLNumber of a delta CRL
+// (RFC 5280 section 5.2.4) and nil for a complete CRL.
+func parseDeltaCRLIndicator(crl *x509.RevocationList) (*big.Int, error) {
+	for _, ext := range crl.Extensions {
+		if !ext.Id.Equal(oidDeltaCRLIndicator) {
+			continue
+		}
+		base := new(big.Int)
+		if _, err := asn1.Unmarshal(ext.Value, &base); err != nil {
+			return nil, err
+		}
+		return base, nil
+	}
+	return nil, nil
+}
+
+// parseExpiredCertsOnCRL returns the date of the expiredCertsOnCRL extension
+// (X.509 section 9.5.2.13): the CRL keeps revoked certificates that expired
+// at or after it. The zero time means the CRL has no such extension.
+func parseExpiredCertsOnCRL(crl *x509.RevocationList) (time.Time, error) {
+	for _, ext := range crl.Extensions {
+		if !ext.Id.Equal(oidExpiredCertsOnCRL) {
+			continue
+		}
+		var t time.Time
+		if _, err := asn1.UnmarshalWithParams(ext.Value, &t, "generalized"); err != nil {
+			return time.Time{}, err
+		}
+		return t, nil
+	}
+	return time.Time{}, nil
+}
+
+// distributionPoint mirrors the DistributionPoint of RFC 5280 section 4.2.1.13,
+// used by the freshestCRL extension of CRLs.
+type distributionPoint struct {
+	DistributionPoint distributionPointName `asn1:"optional,tag:0"`
+	Reasons           asn1.BitString        `asn1:"optional,tag:1"`
+	CRLIssuer         asn1.RawValue         `asn1:"optional,tag:2"`
+}
+
+type distributionPointName struct {
+	FullName     []asn1.RawValue  `asn1:"optional,tag:0"`
+	RelativeName pkix.RDNSequence `asn1:"optional,tag:1"`
+}
+
+// parseFreshestCRL returns the URLs of the delta CRLs named by the
+// freshestCRL extension (RFC 5280 section 5.2.6) of a complete CRL.
+func parseFreshestCRL(crl *x509.RevocationList) ([]string, error) {
+	for _, ext := range crl.Extensions {
+		if !ext.Id.Equal(oidFreshestCRL) {
+			continue
+		}
+		var points []distributionPoint
+		if _, err := asn1.Unmarshal(ext.Value, &points); err != nil {
+			return nil, err
+		}
+		var urls []string
+		for _, dp := range points {
+			for _, name := range dp.DistributionPoint.FullName {
+				// uniformResourceIdentifier [6] IA5String
+				if name.Class == asn1.ClassContextSpecific && name.Tag == 6 {
+					urls = append(urls, string(name.Bytes))
+				}
+			}
+		}
+		return urls, nil
+	}
+	return nil, nil
+}
+
+// Reason codes with a special meaning. keyCompromise may be backdated to
+// when the key was compromised. certificateHold is the only reason that can
+// be lifted, reasonRemoveFromCRL on a delta CRL entry then removes the
+// certificate from the complete CRL.
+const (
+	reasonKeyCompromise   = 1
+	reasonCertificateHold = 6
+	reasonRemoveFromCRL   = 8
+)
+
+// reasonNames are the CRLReason values of RFC 5280 section 5.3.1.
+var reasonNames = map[int]string{
+	0:  "unspecified",
+	1:  "keyCompromise",
+	2:  "cACompromise",
+	3:  "affiliationChanged",
+	4:  "superseded",
+	5:  "cessationOfOperation",
+	6:  "certificateHold",
+	8:  "removeFromCRL",
+	9:  "privilegeWithdrawn",
+	10: "aACompromise",
+}
+
+// reasonName returns the name of a reason code. Entries without a reasonCode
+// extension have code 0 in crypto/x509.
+func reasonName(code int) string {
+	if name, ok := reasonNames[code]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", code)
+}
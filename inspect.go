@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+var inspectEntries = new(bool)
+
+func inspectFlags(fs *flag.FlagSet) {
+	fs.BoolVar(inspectEntries, "entries", false, "list every revoked certificate")
+	checkFlags(fs)
+}
+
+// inspect prints everything we know about the given CRL files.
+func inspect(fs *flag.FlagSet) int {
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return exitUsage
+	}
+	if err := setupLinting(); err != nil {
+		logln("Invalid lint selection:", err)
+		return exitUsage
+	}
+	var err error
+	issuerCerts, err = loadIssuers()
+	if err != nil {
+		logln("Unable to load issuer certificates, signatures are not verified:", err)
+	}
+	if crlFiles, err = loadManifest(); err != nil {
+		logln("Unable to read the CRL manifest:", err)
+	}
+
+	before := findingCount()
+	for _, path := range fs.Args() {
+		inspectFile(path)
+	}
+	if err := writeFindings(os.Stdout); err != nil {
+		logln("Failed to write findings:", err)
+		return exitError
+	}
+	if err := writeExports(); err != nil {
+		logln("Failed to write reports:", err)
+		return exitError
+	}
+	if findingCount() > before {
+		return exitFindings
+	}
+	return exitOK
+}
+
+func inspectFile(path string) {
+	logf("CRL: %s\n", path)
+	ctx := newCRLContext(path)
+	defer func() { recordChecked(ctx) }()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		emit(ctx.finding(severityError, "crl_read_error", err.Error(), nil))
+		return
+	}
+	logf("  Size: %d bytes\n", len(data))
+	if ctx.url != "" {
+		logf("  URL: %s\n", ctx.url)
+	}
+	data, crl, err := parseCRL(data)
+	if err != nil {
+		emit(ctx.finding(severityError, "crl_parse_error", "unable to parse CRL: "+err.Error(), nil))
+		return
+	}
+	ctx.setCRL(crl)
+
+	logf("  Issuer: %s\n", crl.Issuer)
+	logf("  Authority Key ID: %X\n", crl.AuthorityKeyId)
+	if crl.Number != nil {
+		logf("  CRL Number: %s\n", crl.Number)
+	}
+	logf("  Signature Algorithm: %s\n", crl.SignatureAlgorithm)
+	logf("  ThisUpdate: %s\n", crl.ThisUpdate.Format(time.RFC3339))
+	logf("  NextUpdate: %s\n", crl.NextUpdate.Format(time.RFC3339))
+	if idp, err := parseIDP(crl); err != nil {
+		logln("  IDP: unparsable:", err)
+	} else if idp != nil {
+		logf("  IDP: onlyContainsUserCerts=%t onlyContainsCACerts=%t indirectCRL=%t\n",
+			idp.OnlyContainsUserCerts, idp.OnlyContainsCACerts, idp.IndirectCRL)
+	}
+	if urls, err := parseFreshestCRL(crl); err != nil {
+		logln("  Freshest CRL: unparsable:", err)
+	} else if len(urls) > 0 {
+		logf("  Freshest CRL: %s\n", strings.Join(urls, ", "))
+	}
+
+	var issuers []*x509.Certificate
+	if issuerCerts != nil {
+		issuers, _ = verifyCRLSignature(&ctx, crl)
+		for _, issuer := range issuers {
+			logf("  Signature: verified by %s (SHA-256 %s)\n", issuer.Subject, certFingerprint(issuer.Raw))
+		}
+	}
+	if ctx.caOwner != "" {
+		logf("  CA Owner: %s\n", ctx.caOwner)
+	}
+	subscriberCRL, scopeReason := crlScope(crl, issuers)
+	logf("  Subscriber CRL: %t (%s)\n", subscriberCRL, scopeReason)
+	linting(data, subscriberCRL, ctx)
+	if time.Now().After(crl.NextUpdate) {
+		emit(ctx.finding(severityError, "crl_expired", fmt.Sprintf("CRL is expired as of now (%s)", crl.NextUpdate), map[string]string{
+			"nextUpdate": crl.NextUpdate.Format(time.RFC3339),
+			"thisUpdate": crl.ThisUpdate.Format(time.RFC3339),
+		}))
+	}
+
+	if isDeltaCRL(crl) {
+		if base, err := parseDeltaCRLIndicator(crl); err == nil {
+			logf("  Delta CRL of base CRL number: %s\n", base)
+		}
+		logf("  Revocations added to the complete CRL: %d\n", checkDelta(ctx, path, crl))
+	}
+
+	logf("  Revoked entries: %d\n", len(crl.RevokedCertificateEntries))
+	if *inspectEntries {
+		for _, entry := range crl.RevokedCertificateEntries {
+			logf("    %s %s %s\n", formatSerial(entry.SerialNumber),
+				entry.RevocationTime.Format(time.RFC3339), reasonName(entry.ReasonCode))
+		}
+	}
+	logln()
+}
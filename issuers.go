@@ -0,0 +1,248 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+const (
+	issuerIndexFile  = "index.json"
+	crtshDownloadURL = "https://crt.sh/?d="
+)
+
+var issuerStoreDir = "issuers"
+
+// issuerRecord is what we remember from CCADB about a CA certificate in the issuer store.
+type issuerRecord struct {
+	Fingerprint string   `json:"sha256"`
+	Subject     string   `json:"subject"`
+	CAOwner     string   `json:"caOwner,omitempty"`
+	Root        bool     `json:"root"`
+	Stores      []string `json:"stores,omitempty"`
+}
+
+// issuerRecords holds the CCADB data of the issuer store, keyed by fingerprint.
+var issuerRecords map[string]issuerRecord
+
+// issuerRecordsByKey holds the same records keyed by normalized subject and
+// public key of their certificate, for certificates not in the store.
+var issuerRecordsByKey map[recordKey]issuerRecord
+
+type recordKey struct {
+	subject string
+	spki    string
+}
+
+func recordKeyOf(c *x509.Certificate) recordKey {
+	return recordKey{subject: normalizeDN(c.Subject.String()), spki: string(c.RawSubjectPublicKeyInfo)}
+}
+
+// issuerStore collects CA certificates from the CCADB reports during an update.
+type issuerStore struct {
+	mu      sync.Mutex
+	records map[string]issuerRecord
+}
+
+func newIssuerStore() (*issuerStore, error) {
+	if err := os.MkdirAll(issuerStoreDir, 0755); err != nil {
+		return nil, err
+	}
+	return &issuerStore{records: map[string]issuerRecord{}}, nil
+}
+
+// add stores the certificate of a CCADB row. If the report carries no PEM,
+// the certificate is fetched from crt.sh by fingerprint unless we already have it.
+// stores are the root stores that trust the certificate.
+func (s *issuerStore) add(pemInfo, fingerprint, subject, owner string, root bool, stores []string) error {
+	fingerprint = normalizeFingerprint(fingerprint)
+
+	var der []byte
+	if block, _ := pem.Decode([]byte(strings.Trim(pemInfo, "'\" \n"))); block != nil && block.Type == "CERTIFICATE" {
+		der = block.Bytes
+	}
+	if der == nil && fingerprint == "" {
+		return fmt.Errorf("neither PEM nor SHA-256 fingerprint in CCADB record")
+	}
+
+	if der != nil {
+		sum := certFingerprint(der)
+		if fingerprint != "" && fingerprint != sum {
+			return fmt.Errorf("PEM does not match fingerprint %s", fingerprint)
+		}
+		fingerprint = sum
+		if err := writeIssuerPEM(fingerprint, der); err != nil {
+			return err
+		}
+	} else if _, err := os.Stat(issuerPath(fingerprint)); os.IsNotExist(err) {
+		der, err = fetchIssuer(fingerprint)
+		if err != nil {
+			return err
+		}
+		if err := writeIssuerPEM(fingerprint, der); err != nil {
+			return err
+		}
+	}
+	if subject == "" && der != nil {
+		if cert, err := x509.ParseCertificate(der); err == nil {
+			subject = cert.Subject.String()
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// A certificate listed in a root report stays a root.
+	if prev, ok := s.records[fingerprint]; ok {
+		root = root || prev.Root
+		for _, store := range prev.Stores {
+			if !slices.Contains(stores, store) {
+				stores = append(stores, store)
+			}
+		}
+	}
+	s.records[fingerprint] = issuerRecord{
+		Fingerprint: fingerprint,
+		Subject:     subject,
+		CAOwner:     owner,
+		Root:        root,
+		Stores:      stores,
+	}
+	return nil
+}
+
+// save writes the index of the issuer store.
+func (s *issuerStore) save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, err := json.MarshalIndent(s.records, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(issuerStoreDir, issuerIndexFile), data, 0644)
+}
+
+func fetchIssuer(fingerprint string) ([]byte, error) {
+	resp, err := httpClient.Get(crtshDownloadURL + fingerprint)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("crt.sh returned %d for %s", resp.StatusCode, fingerprint)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if block, _ := pem.Decode(data); block != nil {
+		data = block.Bytes
+	}
+	if certFingerprint(data) != fingerprint {
+		return nil, fmt.Errorf("crt.sh returned a different certificate for %s", fingerprint)
+	}
+	return data, nil
+}
+
+func writeIssuerPEM(fingerprint string, der []byte) error {
+	return os.WriteFile(issuerPath(fingerprint), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+func issuerPath(fingerprint string) string {
+	return filepath.Join(issuerStoreDir, fingerprint+".pem")
+}
+
+func certFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+func normalizeFingerprint(fp string) string {
+	fp = strings.ToUpper(strings.TrimSpace(fp))
+	return strings.NewReplacer(":", "", " ", "").Replace(fp)
+}
+
+// loadIssuers loads every certificate of the issuer store and, if present,
+// the optional intermediatesFile.
+func loadIssuers() ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	files, err := filepath.Glob(filepath.Join(issuerStoreDir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(intermediatesFile); err == nil {
+		files = append(files, intermediatesFile)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("issuer store %s is empty, run an update first", issuerStoreDir)
+	}
+
+	seen := map[string]bool{}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		for {
+			var block *pem.Block
+			block, data = pem.Decode(data)
+			if block == nil {
+				break
+			}
+			if block.Type != "CERTIFICATE" {
+				continue
+			}
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				logln("Skipping unparsable certificate in", file, "error:", err)
+				continue
+			}
+			if fp := certFingerprint(cert.Raw); !seen[fp] {
+				seen[fp] = true
+				certs = append(certs, cert)
+			}
+		}
+	}
+
+	data, err := os.ReadFile(filepath.Join(issuerStoreDir, issuerIndexFile))
+	if err == nil {
+		if err := json.Unmarshal(data, &issuerRecords); err != nil {
+			logln("Unable to parse issuer index:", err)
+		}
+	}
+	issuerRecordsByKey = map[recordKey]issuerRecord{}
+	byFingerprint := map[string]*x509.Certificate{}
+	for _, cert := range certs {
+		byFingerprint[certFingerprint(cert.Raw)] = cert
+	}
+	for _, fp := range slices.Sorted(maps.Keys(issuerRecords)) {
+		if cert, ok := byFingerprint[fp]; ok {
+			if _, ok := issuerRecordsByKey[recordKeyOf(cert)]; !ok {
+				issuerRecordsByKey[recordKeyOf(cert)] = issuerRecords[fp]
+			}
+		}
+	}
+
+	logf("Loaded %d issuer certificates.\n", len(certs))
+	return certs, nil
+}
+
+func lookupIssuerRecord(c *x509.Certificate) (issuerRecord, bool) {
+	if rec, ok := issuerRecords[certFingerprint(c.Raw)]; ok {
+		return rec, true
+	}
+	// Certificates that are not in the store by fingerprint, e.g. from
+	// intermediatesFile, are attributed by their subject and key.
+	rec, ok := issuerRecordsByKey[recordKeyOf(c)]
+	return rec, ok
+}
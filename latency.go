@@ -0,0 +1,165 @@
+package main
+
+import (
+	"cmp"
+	"flag"
+	"fmt"
+	"maps"
+	"math"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// latencyDeadline is the longest time allowed between the revocation date of
+// a certificate and the thisUpdate of the first CRL that lists it.
+var latencyDeadline = new(time.Duration)
+
+func latencyFlags(fs *flag.FlagSet) {
+	fs.DurationVar(latencyDeadline, "latency-deadline", 24*time.Hour, "report revocations first published on a CRL later than this after their revocation date")
+}
+
+// revocationLatency is how long it took to publish one revocation.
+type revocationLatency struct {
+	serial string
+	// published is the time from the revocation date to the thisUpdate of
+	// the first CRL with the entry, observed to when we first fetched it.
+	published time.Duration
+	observed  time.Duration
+	// keyCompromise revocations may be dated to when the key was
+	// compromised, they are measured but never reported as late.
+	keyCompromise bool
+}
+
+// caLatencies are the publication latencies of the revocations of one CA.
+type caLatencies struct {
+	entry     manifestEntry
+	latencies []revocationLatency
+}
+
+// measureLatencies goes through the archived versions of all CRLs of every CA
+// in fetch order and measures the latency of each serial when it first shows
+// up. The first archived version of a URL only tells which serials were
+// already published. removeFromCRL entries of delta CRLs are no revocations.
+func measureLatencies(m *crlManifest) map[string]*caLatencies {
+	cas := map[string]*caLatencies{}
+	urls := map[string][]string{}
+	for rel, entry := range m.Files {
+		key := cmp.Or(entry.CAFingerprint, path.Dir(rel))
+		if cas[key] == nil {
+			cas[key] = &caLatencies{entry: entry}
+		}
+		urls[key] = append(urls[key], entry.URL)
+	}
+
+	for key, ca := range cas {
+		var versions []archiveEntry
+		for _, url := range urls[key] {
+			versions = append(versions, history.versions(url)...)
+		}
+		slices.SortStableFunc(versions, func(a, b archiveEntry) int { return a.FetchedAt.Compare(b.FetchedAt) })
+
+		seen := map[string]bool{}
+		baseline := map[string]bool{}
+		for _, v := range versions {
+			crl, err := v.load()
+			if err != nil {
+				continue
+			}
+			measure := baseline[v.URL]
+			baseline[v.URL] = true
+			for _, e := range crl.RevokedCertificateEntries {
+				serial := e.SerialNumber.String()
+				if seen[serial] || e.ReasonCode == reasonRemoveFromCRL {
+					continue
+				}
+				seen[serial] = true
+				if !measure {
+					continue
+				}
+				ca.latencies = append(ca.latencies, revocationLatency{
+					serial:        formatSerial(e.SerialNumber),
+					published:     crl.ThisUpdate.Sub(e.RevocationTime),
+					observed:      v.FetchedAt.Sub(e.RevocationTime),
+					keyCompromise: e.ReasonCode == reasonKeyCompromise,
+				})
+			}
+		}
+	}
+	return cas
+}
+
+// percentile returns the nearest-rank percentile p of sorted durations.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	i := int(math.Ceil(p*float64(len(sorted)))) - 1
+	return sorted[max(i, 0)]
+}
+
+// latencyReport prints the publication latency percentiles per CA and reports
+// the revocations published later than latencyDeadline, except keyCompromise.
+func latencyReport() {
+	m, err := loadManifest()
+	if err != nil {
+		logln("Unable to read the CRL manifest:", err)
+		return
+	}
+	if history, err = loadArchive(); err != nil {
+		logln("Unable to read the CRL archive:", err)
+		return
+	}
+
+	cas := measureLatencies(m)
+	logf("Revocation publication latency per CA (deadline: %s):\n", *latencyDeadline)
+	for _, key := range slices.Sorted(maps.Keys(cas)) {
+		ca := cas[key]
+		if len(ca.latencies) == 0 {
+			continue
+		}
+		published := make([]time.Duration, len(ca.latencies))
+		var observed time.Duration
+		var late []revocationLatency
+		for i, l := range ca.latencies {
+			published[i] = l.published
+			observed = max(observed, l.observed)
+			if l.published > *latencyDeadline && !l.keyCompromise {
+				late = append(late, l)
+			}
+		}
+		slices.Sort(published)
+
+		e := ca.entry
+		name := cmp.Or(e.CASubject, key)
+		logf("  %s (owner: %s): revocations: %d, p50: %s, p90: %s, p99: %s, max: %s, max until fetched: %s, late: %d\n",
+			name, cmp.Or(e.CAOwner, "unknown"), len(published),
+			percentile(published, 0.5).Round(time.Second), percentile(published, 0.9).Round(time.Second),
+			percentile(published, 0.99).Round(time.Second), published[len(published)-1].Round(time.Second),
+			observed.Round(time.Second), len(late))
+		if len(late) == 0 {
+			continue
+		}
+
+		slices.SortFunc(late, func(a, b revocationLatency) int { return cmp.Compare(b.published, a.published) })
+		serials := make([]string, 0, min(len(late), maxListedSerials))
+		for _, l := range late[:min(len(late), maxListedSerials)] {
+			serials = append(serials, l.serial+"="+l.published.Round(time.Second).String())
+		}
+		emit(Finding{
+			Severity:      severityError,
+			RuleID:        "crl_publication_late",
+			CAOwner:       e.CAOwner,
+			CAFingerprint: e.CAFingerprint,
+			Stores:        e.Stores,
+			TrustBits:     e.TrustBits,
+			IssuerDN:      e.CASubject,
+			Message:       fmt.Sprintf("%d revocations of %s were published on a CRL more than %s after their revocation date", len(late), name, *latencyDeadline),
+			Evidence: map[string]string{
+				"count":      strconv.Itoa(len(late)),
+				"deadline":   latencyDeadline.String(),
+				"maxLatency": late[0].published.Round(time.Second).String(),
+				"serials":    strings.Join(serials, " "),
+			},
+		})
+	}
+}
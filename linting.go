@@ -1,74 +1,208 @@
 package main
 
 import (
+	"bytes"
+	stdx509 "crypto/x509"
 	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
 	"github.com/zmap/zcrypto/x509"
 	"github.com/zmap/zlint/v3"
 	"github.com/zmap/zlint/v3/lint"
 )
 
-func linting(data []byte) {
-	parsed, err := x509.ParseRevocationList(data)
+var (
+	lintRegistry  lint.Registry
+	lintThreshold = lint.Warn
+	lintConfigs   = map[bool]lint.Configuration{}
+)
+
+// lintSeverities maps the -lint-min-severity values to zlint result states.
+var lintSeverities = map[string]lint.LintStatus{
+	"info":   lint.Notice,
+	"notice": lint.Notice,
+	"warn":   lint.Warn,
+	"error":  lint.Error,
+	"fatal":  lint.Fatal,
+}
+
+// setupLinting builds the CRL lint registry from the lint flags.
+// Without any filter every registered CRL lint is run.
+func setupLinting() error {
+	threshold, ok := lintSeverities[strings.ToLower(strings.TrimSpace(*lintMinSeverity))]
+	if !ok {
+		return fmt.Errorf("unknown lint severity %q", *lintMinSeverity)
+	}
+
+	includeSources, err := parseLintSources(*lintIncludeSources)
 	if err != nil {
-		// If x509.ParseRevocationList fails, the RevocationList is too broken to lint.
-		// This is the second check but with zcrypto. zcrypto is a bit lazy'r than Golangs x509 implementation.
-		fmt.Println("  LINT: unable to parse revocation List:", err)
-		return
+		return err
+	}
+	excludeSources, err := parseLintSources(*lintExcludeSources)
+	if err != nil {
+		return err
 	}
 
-	var zlintResultSet *zlint.ResultSet
-	isCA := true
-	switch {
-	case isCA:
-		reg, err := lint.GlobalRegistry().Filter(lint.FilterOptions{
-			IncludeNames: []string{"e_crl_next_update_invalid"},
-		})
+	reg, err := lint.GlobalRegistry().Filter(lint.FilterOptions{
+		IncludeNames:   splitList(*lintInclude),
+		ExcludeNames:   splitList(*lintExclude),
+		IncludeSources: includeSources,
+		ExcludeSources: excludeSources,
+	})
+	if err != nil {
+		return err
+	}
+
+	// The nextUpdate limit depends on whether the CRL covers subscriber
+	// certificates, so keep a configuration for either scope around.
+	for _, subscriber := range []bool{true, false} {
+		cfg, err := lint.NewConfigFromString(fmt.Sprintf("[e_crl_next_update_invalid]\nSubscriberCRL = %t\n", subscriber))
 		if err != nil {
-			panic(err)
+			return err
 		}
+		lintConfigs[subscriber] = cfg
+	}
 
-		toml := `
-[e_crl_next_update_invalid]
-SubscriberCRL = false
-`
+	if len(reg.RevocationListLints().Lints()) == 0 {
+		return fmt.Errorf("lint filter does not select any CRL lint")
+	}
+	if *debugLogging {
+		for _, l := range reg.RevocationListLints().Lints() {
+			logln("  LINT: enabled", l.Name, "source:", l.Source)
+		}
+	}
 
-		cfg, err := lint.NewConfigFromString(toml)
-		if err != nil {
-			panic(err)
+	lintRegistry = reg
+	lintThreshold = threshold
+	return nil
+}
+
+// parseLintSources accepts zlint source names case-insensitively.
+// "rfc" selects every RFC source.
+func parseLintSources(raw string) (lint.SourceList, error) {
+	var out lint.SourceList
+	for _, name := range splitList(raw) {
+		if strings.EqualFold(name, "rfc") {
+			out = append(out, lint.RFC3279, lint.RFC5280, lint.RFC5480, lint.RFC5891, lint.RFC6960, lint.RFC6962, lint.RFC8813)
+			continue
+		}
+		var src lint.LintSource
+		for _, known := range lint.GlobalRegistry().Sources() {
+			if strings.EqualFold(string(known), name) {
+				src = known
+			}
+		}
+		if src == "" {
+			return nil, fmt.Errorf("unknown lint source %q", name)
+		}
+		out = append(out, src)
+	}
+	return out, nil
+}
+
+func splitList(raw string) []string {
+	var out []string
+	for _, s := range strings.Split(raw, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			out = append(out, s)
 		}
-		reg.SetConfiguration(cfg)
+	}
+	return out
+}
 
-		zlintResultSet = zlint.LintRevocationListEx(parsed, reg)
+// crlScope decides whether a CRL covers subscriber certificates.
+// The IDP extension is authoritative. Without it the issuer certificates, all
+// that verify the CRL, and the CA certificates disclosed in CCADB tell us what
+// the key can issue. A root and its cross-signed twin share the key, so the
+// answer must not depend on which of them is looked at. CRLs are only treated
+// as CA CRLs on positive evidence, so unknown issuers get the stricter
+// subscriber limits.
+func crlScope(crl *stdx509.RevocationList, issuers []*stdx509.Certificate) (subscriber bool, reason string) {
+	idp, err := parseIDP(crl)
+	if err != nil {
+		return true, "unparsable issuingDistributionPoint: " + err.Error()
+	}
+	if idp != nil && idp.OnlyContainsUserCerts {
+		return true, "IDP onlyContainsUserCerts"
+	}
+	if idp != nil && idp.OnlyContainsCACerts {
+		return false, "IDP onlyContainsCACerts"
+	}
+	if len(issuers) == 0 {
+		return true, "issuer unknown"
+	}
+	for _, issuer := range issuers {
+		if rec, ok := lookupIssuerRecord(issuer); (ok && rec.Root) || isSelfSigned(issuer) {
+			// Root CA keys must not sign subscriber certificates (BR 6.1.7).
+			return false, "issuer is a root CA"
+		}
+	}
+	if slices.ContainsFunc(issuers, func(c *stdx509.Certificate) bool { return c.MaxPathLenZero }) {
+		return true, "issuer has pathLenConstraint 0"
+	}
+	if slices.ContainsFunc(issuers, issuesCAs) {
+		return true, "issuer has subordinate CAs but may also issue subscriber certificates"
+	}
+	return true, "issuer has no subordinate CAs in CCADB"
+}
+
+func isSelfSigned(c *stdx509.Certificate) bool {
+	return bytes.Equal(c.RawSubject, c.RawIssuer) && c.CheckSignatureFrom(c) == nil
+}
 
-	default:
-		zlintResultSet = zlint.LintRevocationList(parsed)
+// issuesCAs reports whether any known CA certificate was issued by c.
+func issuesCAs(c *stdx509.Certificate) bool {
+	for _, ic := range issuerCerts {
+		if ic != c && bytes.Equal(ic.RawIssuer, c.RawSubject) {
+			return true
+		}
+	}
+	return false
+}
+
+// linting runs the selected zlint CRL lints and emits a finding for every
+// result at or above the -lint-min-severity threshold.
+func linting(data []byte, subscriberCRL bool, ctx crlContext) {
+	parsed, err := x509.ParseRevocationList(data)
+	if err != nil {
+		// If x509.ParseRevocationList fails, the RevocationList is too broken to lint.
+		// This is the second check but with zcrypto. zcrypto is a bit lazy'r than Golangs x509 implementation.
+		emit(ctx.finding(severityError, "crl_lint_parse_error", "unable to parse revocation List: "+err.Error(), nil))
+		return
 	}
 
+	lintRegistry.SetConfiguration(lintConfigs[subscriberCRL])
+	zlintResultSet := zlint.LintRevocationListEx(parsed, lintRegistry)
+
+	names := make([]string, 0, len(zlintResultSet.Results))
+	for name := range zlintResultSet.Results {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
 	var errors int
-	if len(zlintResultSet.Results) == 0 {
-		if *debugLogging {
-			fmt.Println("  LINT: No results found")
+	for _, name := range names {
+		result := zlintResultSet.Results[name]
+		if result.Status < lintThreshold {
+			continue
 		}
-	} else {
-		for _, result := range zlintResultSet.Results {
-			if result.Status == lint.Error ||
-				result.Status == lint.Fatal ||
-				result.Status == lint.Warn {
-				errors++
-				if *debugLogging || *showLintErrors {
-					fmt.Println("  LINT: Error:", result.Status)
-					fmt.Println(result.LintMetadata.Description)
-					fmt.Println(result.LintMetadata.Name)
-				}
-			}
+		errors++
+		message := result.Details
+		if message == "" {
+			message = result.LintMetadata.Description
 		}
+		addFinding(ctx.finding(result.Status.String(), name, message, map[string]string{
+			"description":   result.LintMetadata.Description,
+			"citation":      result.LintMetadata.Citation,
+			"source":        string(result.LintMetadata.Source),
+			"subscriberCRL": fmt.Sprint(subscriberCRL),
+		}), *debugLogging || *showLintErrors)
 	}
 	if errors > 0 {
-		fmt.Println("  LINT: Errors found:", errors)
-		fmt.Println("  LINT: AIA:", parsed.AuthorityKeyId, "Issuer:", parsed.Issuer.String())
-	} else if errors == 0 {
-		if *debugLogging {
-			fmt.Println("  LINT: No problems found")
-		}
+		logln("  LINT: Errors found:", errors)
+	} else if *debugLogging {
+		logln("  LINT: No problems found")
 	}
 }
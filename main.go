@@ -3,7 +3,9 @@ package main
 import (
 	"flag"
 	"fmt"
+	"os"
 	"runtime"
+	"strings"
 	"time"
 )
 
@@ -13,38 +15,307 @@ var (
 	// CommitHash holds the Git commit SHA at build time.
 	CommitHash string
 	// GOARCH holds the target architecture string (e.g. "amd64", "arm64") injected at build time.
-	GOARCH            string
-	debugLogging      *bool
-	showLintErrors    *bool
-	clientTimeout     time.Duration = 60 // Seconds
-	intermediatesFile               = "intermediates.pem"
+	GOARCH             string
+	debugLogging       = new(bool)
+	showLintErrors     = new(bool)
+	lintInclude        = new(string)
+	lintExclude        = new(string)
+	lintIncludeSources = new(string)
+	lintExcludeSources = new(string)
+	lintMinSeverity    = new(string)
+	workers            = new(int)
+	perHostLimit       = new(int)
+	retries            = new(int)
+	retryDelay         = new(time.Duration)
+	archiveKeep        = new(int)
+	archiveMaxAge      = new(time.Duration)
+	deleteOrphans      = new(bool)
+	clientTimeout      = new(time.Duration)
+	intermediatesFile  = "intermediates.pem"
 )
 
+// Exit codes shared by all commands.
+const (
+	exitOK       = 0 // success, nothing to report
+	exitFindings = 1 // the command found problems (or, for query, no match)
+	exitUsage    = 2 // invalid command line
+	exitError    = 3 // the command could not do its job
+)
+
+// command is a subcommand of the CLI. Every command has its own flag set.
+type command struct {
+	name    string
+	summary string
+	args    string
+	flags   func(fs *flag.FlagSet)
+	run     func(fs *flag.FlagSet) int
+}
+
+var commands = []command{
+	{
+		name:    "update",
+		summary: "download the CCADB reports, issuer certificates and all CRLs",
+		flags: func(fs *flag.FlagSet) {
+			updateFlags(fs)
+			formatFlag(fs)
+			exportFlags(fs)
+		},
+		run: func(fs *flag.FlagSet) int {
+			banner()
+			code := runUpdate()
+			if err := writeFindings(os.Stdout); err != nil {
+				logln("Failed to write findings:", err)
+				return exitError
+			}
+			if err := writeExports(); err != nil {
+				logln("Failed to write reports:", err)
+				return exitError
+			}
+			return code
+		},
+	},
+	{
+		name:    "check",
+		summary: "verify, lint and check the expiry of the downloaded CRLs",
+		flags:   checkFlags,
+		run: func(fs *flag.FlagSet) int {
+			banner()
+			return runCheck()
+		},
+	},
+	{
+		name:    "run",
+		summary: "update, then check the freshly downloaded CRLs",
+		flags: func(fs *flag.FlagSet) {
+			updateFlags(fs)
+			checkFlags(fs)
+		},
+		run: func(fs *flag.FlagSet) int {
+			banner()
+			updated := runUpdate()
+			if updated == exitError {
+				return updated
+			}
+			if code := runCheck(); code != exitOK {
+				return code
+			}
+			return updated
+		},
+	},
+	{
+		name:    "inspect",
+		summary: "show the details, signature and lint results of CRL files",
+		args:    "<file.crl>...",
+		flags:   inspectFlags,
+		run:     inspect,
+	},
+	{
+		name:    "query",
+		summary: "look up a certificate serial number in the downloaded CRLs",
+		flags:   queryFlags,
+		run:     query,
+	},
+	{
+		name:    "serve",
+		summary: "serve the downloaded CRLs and serial lookups over HTTP",
+		flags:   serveFlags,
+		run:     serve,
+	},
+	{
+		name:    "config",
+		summary: "check the configuration file",
+		args:    "validate",
+		flags:   configCommandFlags,
+		run:     configCommand,
+	},
+	{
+		name:    "report",
+		summary: "report on the download history of the CRL endpoints and the revocation latency",
+		args:    "[conditional|availability|latency]...",
+		flags: func(fs *flag.FlagSet) {
+			formatFlag(fs)
+			latencyFlags(fs)
+		},
+		run: report,
+	},
+}
+
 func main() {
-	updateFlag := flag.Bool("update", true, "update crl files")
-	checkFlag := flag.Bool("check", true, "check crl files")
-	showLintErrors = flag.Bool("show-lint-errors", true, "show linting errors")
-	// ocspFlag := flag.Bool("ocsp", false, "check ocsp responses")
-	debugLogging = flag.Bool("debug", false, "debug mode")
-	flag.Parse()
-
-	// Print Version Information
-	fmt.Println("Starting Certificate Revocation List Monitor.")
-	fmt.Println("Go version:", runtime.Version(),
+	os.Exit(runCommand(os.Args[1:]))
+}
+
+func runCommand(args []string) int {
+	if len(args) == 0 {
+		usage()
+		return exitUsage
+	}
+	if args[0] == "help" || args[0] == "-h" || args[0] == "-help" || args[0] == "--help" {
+		usage()
+		return exitOK
+	}
+
+	for _, cmd := range commands {
+		if cmd.name != args[0] {
+			continue
+		}
+		fs := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+		fs.BoolVar(debugLogging, "debug", false, "debug mode")
+		fs.StringVar(configFile, "config", defaultConfigFile, "TOML configuration file, flags override its settings")
+		cmd.flags(fs)
+		fs.Usage = func() {
+			fmt.Fprintf(fs.Output(), "Usage: %s %s [flags] %s\n\n%s.\n\nFlags:\n", os.Args[0], cmd.name, cmd.args, cmd.summary)
+			fs.PrintDefaults()
+		}
+		if err := fs.Parse(args[1:]); err != nil {
+			if err == flag.ErrHelp {
+				return exitOK
+			}
+			return exitUsage
+		}
+		if err := applyConfig(fs); err != nil {
+			fmt.Fprintln(os.Stderr, "Invalid configuration:", err)
+			return exitUsage
+		}
+		if err := setupOutput(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitUsage
+		}
+		if *debugLogging {
+			logln("Debug logging enabled")
+		}
+		return cmd.run(fs)
+	}
+
+	fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", args[0])
+	usage()
+	return exitUsage
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [flags]\n\nCommands:\n", os.Args[0])
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun '%s <command> -h' for the flags of a command.\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "\nExit codes: %d success, %d problems found, %d usage error, %d failure.\n",
+		exitOK, exitFindings, exitUsage, exitError)
+}
+
+// banner prints version information.
+func banner() {
+	logln("Starting Certificate Revocation List Monitor.")
+	logln("Go version:", runtime.Version(),
 		"BuildTime:", BuildTime,
 		"CommitHash:", CommitHash,
 		"GOARCH:", GOARCH)
+}
 
-	if *debugLogging {
-		fmt.Println("Debug logging enabled")
-	}
+func updateFlags(fs *flag.FlagSet) {
+	fs.StringVar(ccadbURL, "ccadb-url", defaultCCADBURL, "URL of the CCADB intermediate report")
+	fs.StringVar(ccadbFile, "ccadb-file", "", "read the CCADB intermediate report from this file instead of downloading it")
+	fs.StringVar(ccadbRootsURL, "ccadb-roots-url", defaultCCADBRootsURL, "URL of the CCADB root report")
+	fs.StringVar(ccadbRootsFile, "ccadb-roots-file", "", "read the CCADB root report from this file instead of downloading it")
+	fs.StringVar(ccadbAllURL, "ccadb-all-url", defaultCCADBAllURL, "URL of the CCADB report of all certificate records, used for the other root stores")
+	fs.StringVar(ccadbAllFile, "ccadb-all-file", "", "read the CCADB report of all certificate records from this file instead of downloading it")
+	fs.StringVar(updateStores, "stores", strings.Join(rootStores, ","), "comma separated root stores to collect CAs from: "+strings.Join(rootStores, ", ")+" (empty: none)")
+	fs.StringVar(customSources, "sources", "", "TOML file of custom CAs and CRLs to monitor in addition to CCADB")
+	fs.DurationVar(clientTimeout, "timeout", 60*time.Second, "timeout of a single HTTP request")
+	fs.IntVar(workers, "workers", 32, "number of concurrent downloads")
+	fs.IntVar(perHostLimit, "per-host", 4, "maximum concurrent downloads from the same host")
+	fs.IntVar(retries, "retries", 3, "number of retries for failed downloads")
+	fs.DurationVar(retryDelay, "retry-delay", 2*time.Second, "initial delay between retries, doubled per attempt")
+	fs.IntVar(archiveKeep, "archive-keep", 0, "number of CRL versions to keep per URL in the archive (0: unlimited)")
+	fs.DurationVar(archiveMaxAge, "archive-max-age", 0, "remove archived CRL versions older than this (0: unlimited)")
+	fs.BoolVar(deleteOrphans, "delete-orphans", false, "delete the CRLs of CAs that are no longer listed instead of moving them to the archive")
+}
+
+func checkFlags(fs *flag.FlagSet) {
+	fs.BoolVar(showLintErrors, "show-lint-errors", true, "show linting errors")
+	formatFlag(fs)
+	fs.StringVar(filterStores, "filter-stores", "", "only report findings for CAs in these comma separated root stores, e.g. chrome,apple")
+	fs.StringVar(notifyWebhook, "notify-webhook", "", "URL to POST the findings to as JSON")
+	exportFlags(fs)
+	lintFlags(fs)
+}
+
+func exportFlags(fs *flag.FlagSet) {
+	fs.StringVar(sarifFile, "sarif", "", "also write the findings as SARIF 2.1.0 to this file")
+	fs.StringVar(junitFile, "junit", "", "also write a JUnit XML report with one test case per CRL to this file")
+}
 
-	if *checkFlag {
-		check()
+func formatFlag(fs *flag.FlagSet) {
+	fs.StringVar(outputFormat, "format", "text", "output format of the findings: text, json, jsonl or csv")
+}
+
+func lintFlags(fs *flag.FlagSet) {
+	fs.StringVar(lintInclude, "lint-include", "", "comma separated lint names to run (default: all CRL lints)")
+	fs.StringVar(lintExclude, "lint-exclude", "", "comma separated lint names to skip")
+	fs.StringVar(lintIncludeSources, "lint-include-sources", "", "comma separated lint sources to run, e.g. cabf_br,rfc,community")
+	fs.StringVar(lintExcludeSources, "lint-exclude-sources", "", "comma separated lint sources to skip")
+	fs.StringVar(lintMinSeverity, "lint-min-severity", "warn", "minimum lint result to report: info, warn, error or fatal")
+}
+
+// runUpdate updates the CRLs. The findings, e.g. CRLs going backwards or
+// revocations removed from a CRL, are left to the caller to write. Only
+// warnings and worse count as problems, not e.g. CAs that left CCADB.
+func runUpdate() int {
+	if err := updateCRLs(); err != nil {
+		logln("Update failed:", err)
+		return exitError
+	}
+	if problemCount() > 0 {
+		return exitFindings
 	}
+	return exitOK
+}
 
-	if *updateFlag {
-		updateCRLs()
+func runCheck() int {
+	problems, err := check()
+	if err != nil {
+		logln("Check failed:", err)
+		return exitError
+	}
+	if err := writeFindings(os.Stdout); err != nil {
+		logln("Failed to write findings:", err)
+		return exitError
+	}
+	if err := writeExports(); err != nil {
+		logln("Failed to write reports:", err)
+		return exitError
+	}
+	if err := notify(); err != nil {
+		logln("Failed to send notification:", err)
+	}
+	if problems > 0 {
+		return exitFindings
 	}
+	return exitOK
+}
 
+func report(fs *flag.FlagSet) int {
+	sections := fs.Args()
+	if len(sections) == 0 {
+		sections = []string{"conditional", "availability", "latency"}
+	}
+	for _, section := range sections {
+		switch section {
+		case "conditional":
+			conditionalReport(outputBaseDir)
+		case "availability":
+			availabilityReport(outputBaseDir)
+		case "latency":
+			latencyReport()
+		default:
+			fmt.Fprintf(os.Stderr, "Unknown report %q\n", section)
+			return exitUsage
+		}
+	}
+	if err := writeFindings(os.Stdout); err != nil {
+		logln("Failed to write findings:", err)
+		return exitError
+	}
+	if findingCount() > 0 {
+		return exitFindings
+	}
+	return exitOK
 }
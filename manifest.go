@@ -0,0 +1,434 @@
+package main
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const manifestFile = "manifest.json"
+
+// manifestEntry tells where a CRL file below outputBaseDir comes from.
+type manifestEntry struct {
+	URL           string        `json:"url"`
+	CAFingerprint string        `json:"caFingerprint,omitempty"`
+	CASubject     string        `json:"caSubject,omitempty"`
+	CAOwner       string        `json:"caOwner,omitempty"`
+	Stores        []string      `json:"stores,omitempty"`
+	TrustBits     string        `json:"trustBits,omitempty"`
+	Sources       []string      `json:"sources,omitempty"`
+	Cadence       time.Duration `json:"cadence,omitempty"`
+	// DeltaOf is set for delta CRLs to the path of their complete CRL.
+	DeltaOf string `json:"deltaOf,omitempty"`
+	// SameAs is set when the URL is shared with another CA certificate, e.g.
+	// a cross-signed one, to the path the CRL is stored at. There is no file
+	// at the path of this entry.
+	SameAs string `json:"sameAs,omitempty"`
+}
+
+// crlManifest maps every CRL file, by its path relative to outputBaseDir,
+// to the CA record it was downloaded for.
+type crlManifest struct {
+	mu      sync.Mutex
+	Updated time.Time                `json:"updated"`
+	Files   map[string]manifestEntry `json:"files"`
+}
+
+// loadManifest reads the manifest of outputBaseDir. A missing manifest is empty.
+func loadManifest() (*crlManifest, error) {
+	m := &crlManifest{Files: map[string]manifestEntry{}}
+	data, err := os.ReadFile(filepath.Join(outputBaseDir, manifestFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return m, nil
+		}
+		return m, err
+	}
+	if err := json.Unmarshal(data, m); err != nil {
+		return &crlManifest{Files: map[string]manifestEntry{}}, err
+	}
+	if m.Files == nil {
+		m.Files = map[string]manifestEntry{}
+	}
+	return m, nil
+}
+
+func (m *crlManifest) add(path string, entry manifestEntry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if rel, err := filepath.Rel(outputBaseDir, path); err == nil {
+		path = rel
+	}
+	m.Files[filepath.ToSlash(path)] = entry
+}
+
+// lookup returns the manifest entry of a CRL file.
+func (m *crlManifest) lookup(path string) (manifestEntry, bool) {
+	if m == nil {
+		return manifestEntry{}, false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rel, err := filepath.Rel(outputBaseDir, path)
+	if err != nil {
+		return manifestEntry{}, false
+	}
+	entry, ok := m.Files[filepath.ToSlash(rel)]
+	return entry, ok
+}
+
+func (m *crlManifest) save() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Updated = time.Now().UTC()
+	if err := os.MkdirAll(outputBaseDir, 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(outputBaseDir, manifestFile), data)
+}
+
+// crlFilePath returns where the CRL at url is stored for a CA: a directory
+// per CA certificate fingerprint and a file per URL hash, so neither
+// partitions with the same file name nor CAs with the same name collide.
+func crlFilePath(ca caEntry, url string) string {
+	dir := ca.fingerprint
+	if dir == "" {
+		sum := sha256.Sum256([]byte(ca.subject + "|" + ca.issuer + "|" + ca.subjectCN))
+		dir = "unknown-" + hex.EncodeToString(sum[:8])
+	}
+	return filepath.Join(outputBaseDir, dir, crlFileName(url))
+}
+
+// crlFileName is the file name of the CRL at url within the directory of its CA.
+func crlFileName(url string) string {
+	return urlHash(url) + ".crl"
+}
+
+// urlHash is a short hash of the cleaned url for file names.
+func urlHash(url string) string {
+	sum := sha256.Sum256([]byte(cleanURL(url)))
+	return hex.EncodeToString(sum[:8])
+}
+
+func (ca caEntry) manifestEntry(url string) manifestEntry {
+	return manifestEntry{
+		URL:           cleanURL(url),
+		CAFingerprint: ca.fingerprint,
+		CASubject:     ca.name(),
+		CAOwner:       ca.owner,
+		Stores:        ca.storeList(),
+		TrustBits:     ca.trustBits,
+		Sources:       ca.sources,
+		Cadence:       ca.cadence,
+	}
+}
+
+// migrateLegacyLayout moves CRLs stored by older versions below
+// crls/<O>/<CN>/ to their new path, keeping the metadata for conditional
+// requests. planned maps every URL to be downloaded to its new path, legacy
+// maps the legacy path of a planned CRL, see legacyCRLPath, to its new path.
+// The first versions wrote no metadata, their CRLs are only found that way.
+func migrateLegacyLayout(m *crlManifest, planned, legacy map[string]string) {
+	var moved int
+	move := func(crlPath, dest string) {
+		if _, ok := m.lookup(crlPath); ok || dest == crlPath {
+			return
+		}
+		if _, err := os.Stat(dest); err == nil {
+			return
+		}
+		if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			return
+		}
+		if err := os.Rename(crlPath, dest); err != nil && !os.IsNotExist(err) {
+			logf("Failed to move %s to %s: %v\n", crlPath, dest, err)
+			return
+		}
+		if err := os.Rename(metaPath(crlPath), metaPath(dest)); err != nil && !os.IsNotExist(err) {
+			logf("Failed to move %s to %s: %v\n", metaPath(crlPath), metaPath(dest), err)
+			return
+		}
+		moved++
+		// Remove the legacy directories that are empty now.
+		base := filepath.Clean(outputBaseDir)
+		for dir := filepath.Dir(crlPath); dir != base && dir != "."; dir = filepath.Dir(dir) {
+			if os.Remove(dir) != nil {
+				break
+			}
+		}
+	}
+
+	for _, crlPath := range slices.Sorted(maps.Keys(legacy)) {
+		if info, err := os.Stat(crlPath); err == nil && !info.IsDir() {
+			move(crlPath, legacy[crlPath])
+		}
+	}
+	filepath.Walk(outputBaseDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || filepath.Ext(path) != ".json" || filepath.Base(path) == manifestFile {
+			return nil
+		}
+		crlPath := path[:len(path)-len(metaSuffix)]
+		if metaPath(crlPath) != path {
+			return nil
+		}
+		if _, ok := m.lookup(crlPath); ok {
+			return nil
+		}
+		meta, err := loadMeta(crlPath)
+		if err != nil || meta.URL == "" {
+			return nil
+		}
+		if dest, ok := planned[meta.URL]; ok {
+			move(crlPath, dest)
+		}
+		return nil
+	})
+	if moved > 0 {
+		logf("Moved %d CRLs to the fingerprint based layout.\n", moved)
+	}
+}
+
+// legacyReplacer replaces the characters the first versions did not allow in
+// the issuer DN, which named the directory of a CRL.
+var legacyReplacer = strings.NewReplacer("/", "_", `\`, "_", ":", "_", "*", "_", "?", "_", `"`, "_", "<", "_", ">", "_", "|", "_")
+
+// legacyCRLPath returns where the first versions stored a CRL of a CCADB
+// intermediate: crls/<issuer O>/<subject CN>/<last element of the URL>, with
+// the DNs split at every ',' and ';'. It returns "" for other CAs.
+func legacyCRLPath(ca caEntry, url string) string {
+	if ca.subject == "" || ca.issuer == "" {
+		return ""
+	}
+	attr := func(dn, prefix string) string {
+		var value string
+		for _, part := range strings.FieldsFunc(dn, func(r rune) bool { return r == ',' || r == ';' }) {
+			if part = strings.TrimSpace(part); strings.HasPrefix(part, prefix) {
+				value = strings.TrimPrefix(part, prefix)
+			}
+		}
+		return value
+	}
+	issuer := strings.TrimSpace(legacyReplacer.Replace(ca.issuer))
+	return filepath.Join(outputBaseDir, attr(issuer, "O="), attr(ca.subject, "CN="), filepath.Base(url))
+}
+
+// orphanedDir keeps the CRLs of CAs that are no longer listed, below archiveDir.
+const orphanedDir = "orphaned"
+
+// orphanedCA is a CA that had CRLs below outputBaseDir but is no longer
+// listed by the selected sources.
+type orphanedCA struct {
+	entry manifestEntry
+	urls  []string
+}
+
+// orphanScope is what an update had a complete view of: the sources that
+// were loaded and the selected root stores.
+type orphanScope struct {
+	sources map[string]bool
+	stores  []string
+}
+
+// covers reports whether the CA of e could only have been listed by sources
+// and stores in scope, so its absence means it is no longer listed.
+func (s orphanScope) covers(e manifestEntry) bool {
+	for _, source := range e.Sources {
+		if !s.sources[source] {
+			return false
+		}
+	}
+	for _, store := range e.Stores {
+		if !slices.Contains(s.stores, store) {
+			return false
+		}
+	}
+	return true
+}
+
+// collectOrphans removes every CRL below outputBaseDir that is not in m,
+// because its CA left CCADB or the URL is no longer disclosed, together with
+// its metadata. The files are moved to archive/orphaned unless remove is set.
+// previous, the manifest of the last update, tells which CAs disappeared.
+// CRLs of CAs outside scope, e.g. of a root store not selected this time or a
+// report that failed to load, are kept in m as they were.
+func collectOrphans(m, previous *crlManifest, scope orphanScope, remove bool) {
+	orphans := map[string]*orphanedCA{}
+	emptied := map[string]bool{}
+	var leftovers int
+	filepath.Walk(outputBaseDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		// The metadata of a CRL that never downloaded has no CRL file.
+		if strings.HasSuffix(path, metaSuffix) {
+			path = strings.TrimSuffix(path, metaSuffix)
+			if _, err := os.Stat(path); err == nil {
+				return nil
+			}
+		} else if filepath.Ext(path) != ".crl" {
+			return nil
+		}
+		if entry, ok := m.lookup(path); ok {
+			// A copy from before shared URLs were stored once.
+			if entry.SameAs != "" {
+				if err := removeOrphan(path, remove); err != nil {
+					logf("Failed to remove duplicate CRL %s: %v\n", path, err)
+					return nil
+				}
+				emptied[filepath.Dir(path)] = true
+			}
+			return nil
+		}
+
+		entry, known := previous.lookup(path)
+		if known && !scope.covers(entry) {
+			m.add(path, entry)
+			return nil
+		}
+		if err := removeOrphan(path, remove); err != nil {
+			logf("Failed to remove orphaned CRL %s: %v\n", path, err)
+			return nil
+		}
+
+		emptied[filepath.Dir(path)] = true
+		// Left over from the legacy layout: it tells nothing about which CA
+		// disappeared.
+		if !known {
+			leftovers++
+			return nil
+		}
+
+		key := cmp.Or(entry.CAFingerprint, entry.CASubject)
+		ca, ok := orphans[key]
+		if !ok {
+			ca = &orphanedCA{entry: entry}
+			orphans[key] = ca
+		}
+		ca.urls = append(ca.urls, cmp.Or(entry.URL, path))
+		return nil
+	})
+
+	// Remove the directories that are empty now, up to outputBaseDir. The
+	// directories of the CRLs about to be downloaded stay.
+	needed := map[string]bool{}
+	for rel, entry := range m.Files {
+		if entry.SameAs != "" {
+			continue
+		}
+		needed[filepath.Join(outputBaseDir, filepath.Dir(filepath.FromSlash(rel)))] = true
+	}
+	base := filepath.Clean(outputBaseDir)
+	for dir := range emptied {
+		for ; dir != base && dir != "." && !needed[dir]; dir = filepath.Dir(dir) {
+			if os.Remove(dir) != nil {
+				break
+			}
+		}
+	}
+
+	action := "archived to " + filepath.Join(archiveDir, orphanedDir)
+	if remove {
+		action = "deleted"
+	}
+	if leftovers > 0 {
+		logf("CRLs of the legacy layout no listed CA uses: %d, %s\n", leftovers, action)
+	}
+	if len(orphans) == 0 {
+		return
+	}
+
+	// A CA that still has CRLs in m is listed, it only stopped disclosing
+	// some of its URLs.
+	listed := map[string]bool{}
+	for _, e := range m.Files {
+		listed[cmp.Or(e.CAFingerprint, e.CASubject)] = true
+	}
+	var gone []string
+	for _, key := range slices.Sorted(maps.Keys(orphans)) {
+		ca := orphans[key]
+		sort.Strings(ca.urls)
+		if !listed[key] {
+			gone = append(gone, key)
+			continue
+		}
+		e := ca.entry
+		for _, url := range ca.urls {
+			emit(Finding{
+				Severity:      severityInfo,
+				RuleID:        "crl_url_no_longer_disclosed",
+				CAOwner:       e.CAOwner,
+				CAFingerprint: e.CAFingerprint,
+				Stores:        e.Stores,
+				TrustBits:     e.TrustBits,
+				IssuerDN:      e.CASubject,
+				CRLURL:        url,
+				Message:       fmt.Sprintf("%s no longer discloses this CRL, %s", e.CASubject, action),
+			})
+		}
+	}
+	if len(gone) == 0 {
+		return
+	}
+
+	logf("CAs no longer listed by the selected sources: %d\n", len(gone))
+	for _, key := range gone {
+		ca := orphans[key]
+		e := ca.entry
+		name := cmp.Or(e.CASubject, "unknown CA")
+		logf("  %s (owner: %s, SHA-256: %s, CRLs: %d, %s)\n", name, cmp.Or(e.CAOwner, "unknown"), cmp.Or(e.CAFingerprint, "unknown"), len(ca.urls), action)
+		emit(Finding{
+			Severity:      severityInfo,
+			RuleID:        "ca_no_longer_listed",
+			CAOwner:       e.CAOwner,
+			CAFingerprint: e.CAFingerprint,
+			Stores:        e.Stores,
+			TrustBits:     e.TrustBits,
+			IssuerDN:      e.CASubject,
+			Message:       fmt.Sprintf("%s is no longer listed by the selected sources, CRLs %s: %d", name, action, len(ca.urls)),
+			Evidence:      map[string]string{"urls": strings.Join(ca.urls, " ")},
+		})
+	}
+}
+
+// removeOrphan moves a CRL and its metadata to archive/orphaned, keeping the
+// path below outputBaseDir, or deletes both if remove is set.
+func removeOrphan(path string, remove bool) error {
+	if remove {
+		for _, file := range []string{path, metaPath(path)} {
+			if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		return nil
+	}
+
+	rel, err := filepath.Rel(outputBaseDir, path)
+	if err != nil {
+		return err
+	}
+	dest := filepath.Join(archiveDir, orphanedDir, rel)
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(path, dest); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Rename(metaPath(path), metaPath(dest)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
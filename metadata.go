@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const metaSuffix = ".meta.json"
+
+// crlMeta is stored next to every downloaded CRL and remembers what the
+// server told us about it, so the next run can send a conditional request.
+type crlMeta struct {
+	URL          string    `json:"url"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"lastModified,omitempty"`
+	SHA256       string    `json:"sha256,omitempty"`
+	LastFetched  time.Time `json:"lastFetched"`
+	LastStatus   int       `json:"lastStatus"`
+	// Cadence is the publication interval configured for a custom source.
+	Cadence time.Duration `json:"cadence,omitempty"`
+	// CRLNumber and ThisUpdate are the highest seen at this URL, so a CRL
+	// that goes backwards is reported on every download.
+	CRLNumber  string    `json:"crlNumber,omitempty"`
+	ThisUpdate time.Time `json:"thisUpdate,omitempty"`
+
+	// Counters for the conditional request report.
+	Requests            int `json:"requests"`
+	ConditionalRequests int `json:"conditionalRequests"`
+	NotModified         int `json:"notModified"`
+	// UnchangedDownloads counts 200 responses to a conditional request that
+	// carried the content we already had.
+	UnchangedDownloads int `json:"unchangedDownloads"`
+	// Quarantined counts responses that were not a parsable CRL.
+	Quarantined int `json:"quarantined"`
+
+	// Attempts holds every request of the last run.
+	Attempts []downloadAttempt `json:"attempts,omitempty"`
+	// Failures counts runs in which the CRL could not be fetched at all,
+	// RetriedSuccesses runs in which it was only fetched after a retry.
+	Failures            int `json:"failures"`
+	RetriedSuccesses    int `json:"retriedSuccesses"`
+	ConsecutiveFailures int `json:"consecutiveFailures"`
+}
+
+func (m *crlMeta) recordAttempts(attempts []downloadAttempt, ok bool) {
+	m.Attempts = attempts
+	if !ok {
+		m.Failures++
+		m.ConsecutiveFailures++
+		return
+	}
+	m.ConsecutiveFailures = 0
+	if len(attempts) > 1 {
+		m.RetriedSuccesses++
+	}
+}
+
+func metaPath(crlPath string) string {
+	return crlPath + metaSuffix
+}
+
+// loadMeta returns the metadata of a CRL, or empty metadata if there is none yet.
+func loadMeta(crlPath string) (*crlMeta, error) {
+	meta := &crlMeta{}
+	data, err := os.ReadFile(metaPath(crlPath))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return meta, nil
+		}
+		return meta, err
+	}
+	if err := json.Unmarshal(data, meta); err != nil {
+		return &crlMeta{}, err
+	}
+	return meta, nil
+}
+
+func saveMeta(crlPath string, meta *crlMeta) error {
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(metaPath(crlPath), data, 0644)
+}
+
+// hostStats aggregates the conditional request counters of all CRLs of one host.
+type hostStats struct {
+	host                string
+	crls                int
+	withValidators      int
+	conditionalRequests int
+	notModified         int
+	unchangedDownloads  int
+}
+
+func (h hostStats) verdict() string {
+	switch {
+	case h.withValidators == 0:
+		return "sends no ETag or Last-Modified"
+	case h.notModified > 0 && h.unchangedDownloads == 0:
+		return "honours conditional requests"
+	case h.notModified > 0:
+		return "honours conditional requests partially"
+	case h.unchangedDownloads > 0:
+		return "ignores conditional requests"
+	default:
+		return "not enough data"
+	}
+}
+
+// walkMeta calls fn for the metadata of every CRL below baseDir.
+func walkMeta(baseDir string, fn func(meta *crlMeta)) error {
+	return filepath.Walk(baseDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !strings.HasSuffix(path, metaSuffix) {
+			return nil
+		}
+		meta, err := loadMeta(strings.TrimSuffix(path, metaSuffix))
+		if err != nil {
+			logln("Unable to read metadata", path, "error:", err)
+			return nil
+		}
+		fn(meta)
+		return nil
+	})
+}
+
+// conditionalReport prints per host whether conditional requests are honoured.
+func conditionalReport(baseDir string) {
+	stats := map[string]*hostStats{}
+	err := walkMeta(baseDir, func(meta *crlMeta) {
+		host := hostOf(meta.URL)
+		h, ok := stats[host]
+		if !ok {
+			h = &hostStats{host: host}
+			stats[host] = h
+		}
+		h.crls++
+		if meta.ETag != "" || meta.LastModified != "" {
+			h.withValidators++
+		}
+		h.conditionalRequests += meta.ConditionalRequests
+		h.notModified += meta.NotModified
+		h.unchangedDownloads += meta.UnchangedDownloads
+	})
+	if err != nil {
+		logf("Error walking directory: %v\n", err)
+		return
+	}
+
+	hosts := make([]string, 0, len(stats))
+	for host := range stats {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	logln("Conditional request support per host:")
+	for _, host := range hosts {
+		h := stats[host]
+		logf("  %s: %s (CRLs: %d, conditional requests: %d, 304: %d, unchanged 200: %d)\n",
+			h.host, h.verdict(), h.crls, h.conditionalRequests, h.notModified, h.unchangedDownloads)
+	}
+}
+
+// availabilityReport lists CRL endpoints that are down or needed retries.
+// An endpoint is down if its last run failed completely, and flaky if it
+// answered in the last run but failed before or only answered after retries.
+func availabilityReport(baseDir string) {
+	var down, flaky, invalid []string
+	err := walkMeta(baseDir, func(meta *crlMeta) {
+		if meta.Quarantined > 0 {
+			invalid = append(invalid, fmt.Sprintf("%s (quarantined responses: %d)", meta.URL, meta.Quarantined))
+		}
+		switch {
+		case meta.ConsecutiveFailures > 0:
+			reason := ""
+			if n := len(meta.Attempts); n > 0 {
+				last := meta.Attempts[n-1]
+				reason = last.Error
+				if reason == "" {
+					reason = fmt.Sprintf("HTTP %d", last.Status)
+				}
+			}
+			down = append(down, fmt.Sprintf("%s (failed runs in a row: %d, last: %s)", meta.URL, meta.ConsecutiveFailures, reason))
+		case meta.Failures > 0 || meta.RetriedSuccesses > 0:
+			flaky = append(flaky, fmt.Sprintf("%s (failed runs: %d, runs needing retries: %d, attempts in last run: %d)",
+				meta.URL, meta.Failures, meta.RetriedSuccesses, len(meta.Attempts)))
+		}
+	})
+	if err != nil {
+		logf("Error walking directory: %v\n", err)
+		return
+	}
+
+	sort.Strings(down)
+	sort.Strings(flaky)
+	logf("CRL endpoints down: %d\n", len(down))
+	for _, line := range down {
+		logln("  " + line)
+	}
+	logf("CRL endpoints flaky: %d\n", len(flaky))
+	for _, line := range flaky {
+		logln("  " + line)
+	}
+	sort.Strings(invalid)
+	logf("CRL endpoints serving invalid CRLs: %d\n", len(invalid))
+	for _, line := range invalid {
+		logln("  " + line)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// notifyWebhook receives the findings of a check as JSON.
+var notifyWebhook = new(string)
+
+// notify posts the findings to the webhook, if one is configured and there
+// is anything to report.
+func notify() error {
+	if *notifyWebhook == "" {
+		return nil
+	}
+	findingsMu.Lock()
+	list := append([]Finding(nil), findings...)
+	findingsMu.Unlock()
+	if len(list) == 0 {
+		return nil
+	}
+
+	body, err := json.Marshal(map[string]any{
+		"tool":     "Gocrl",
+		"time":     time.Now().UTC().Format(time.RFC3339),
+		"findings": list,
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := http.Post(*notifyWebhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %d", resp.StatusCode)
+	}
+	return nil
+}
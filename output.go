@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Finding severities, ordered like the zlint result states.
+const (
+	severityInfo  = "info"
+	severityWarn  = "warn"
+	severityError = "error"
+	severityFatal = "fatal"
+)
+
+// Finding is a single problem reported by a check.
+type Finding struct {
+	Severity      string            `json:"severity"`
+	RuleID        string            `json:"ruleId"`
+	CAOwner       string            `json:"caOwner,omitempty"`
+	CAFingerprint string            `json:"caFingerprint,omitempty"`
+	Stores        []string          `json:"stores,omitempty"`
+	TrustBits     string            `json:"trustBits,omitempty"`
+	IssuerDN      string            `json:"issuerDN,omitempty"`
+	AKI           string            `json:"aki,omitempty"`
+	CRLURL        string            `json:"crlURL,omitempty"`
+	Path          string            `json:"path,omitempty"`
+	Message       string            `json:"message"`
+	Evidence      map[string]string `json:"evidence,omitempty"`
+}
+
+var (
+	outputFormat = new(string)
+	filterStores = new(string)
+	// logOutput receives progress messages. With a structured output format
+	// stdout is reserved for the findings, so progress goes to stderr.
+	logOutput io.Writer = os.Stdout
+
+	findingsMu sync.Mutex
+	findings   []Finding
+)
+
+var outputFormats = []string{"text", "json", "jsonl", "csv"}
+
+// setupOutput validates -format and routes progress messages accordingly.
+func setupOutput() error {
+	switch *outputFormat {
+	case "", "text":
+		logOutput = os.Stdout
+	case "json", "jsonl", "csv":
+		logOutput = os.Stderr
+	default:
+		return fmt.Errorf("unknown output format %q, use one of %s", *outputFormat, strings.Join(outputFormats, ", "))
+	}
+	return nil
+}
+
+func logf(format string, args ...any) {
+	fmt.Fprintf(logOutput, format, args...)
+}
+
+func logln(args ...any) {
+	fmt.Fprintln(logOutput, args...)
+}
+
+// emit records a finding. In text mode it is printed right away.
+func emit(f Finding) {
+	addFinding(f, true)
+}
+
+// addFinding records a finding and, in text mode, prints it if show is set.
+// Findings of CAs outside the root stores selected by -filter-stores are dropped.
+func addFinding(f Finding, show bool) {
+	if !inFilteredStores(f) {
+		return
+	}
+	findingsMu.Lock()
+	findings = append(findings, f)
+	findingsMu.Unlock()
+
+	if show && (*outputFormat == "" || *outputFormat == "text") {
+		writeTextFinding(logOutput, f)
+	}
+}
+
+func inFilteredStores(f Finding) bool {
+	if *filterStores == "" {
+		return true
+	}
+	for _, store := range splitList(strings.ToLower(*filterStores)) {
+		if slices.Contains(f.Stores, store) {
+			return true
+		}
+	}
+	return false
+}
+
+// findingCount returns the number of findings emitted so far.
+func findingCount() int {
+	findingsMu.Lock()
+	defer findingsMu.Unlock()
+	return len(findings)
+}
+
+// problemCount returns the number of findings emitted so far that are more
+// than informational.
+func problemCount() int {
+	findingsMu.Lock()
+	defer findingsMu.Unlock()
+	var n int
+	for _, f := range findings {
+		if f.Severity != severityInfo {
+			n++
+		}
+	}
+	return n
+}
+
+func writeTextFinding(w io.Writer, f Finding) {
+	fmt.Fprintf(w, "  → [%s] %s: %s\n", f.Severity, f.RuleID, f.Message)
+	if f.Path != "" {
+		fmt.Fprintf(w, "    CRL: %s\n", f.Path)
+	}
+	if f.CRLURL != "" {
+		fmt.Fprintf(w, "    URL: %s\n", f.CRLURL)
+	}
+	if f.IssuerDN != "" {
+		fmt.Fprintf(w, "    Issuer: %s\n", f.IssuerDN)
+	}
+	if f.CAOwner != "" {
+		fmt.Fprintf(w, "    CA Owner: %s\n", f.CAOwner)
+	}
+	if len(f.Stores) > 0 {
+		fmt.Fprintf(w, "    Root stores: %s\n", strings.Join(f.Stores, ", "))
+	}
+	if f.CAFingerprint != "" && *debugLogging {
+		fmt.Fprintf(w, "    CA SHA-256: %s\n", f.CAFingerprint)
+	}
+	if f.TrustBits != "" && *debugLogging {
+		fmt.Fprintf(w, "    Trust bits: %s\n", f.TrustBits)
+	}
+	if *debugLogging {
+		for _, k := range sortedKeys(f.Evidence) {
+			fmt.Fprintf(w, "    %s: %s\n", k, f.Evidence[k])
+		}
+	}
+}
+
+// writeFindings writes all findings in a structured format. Text findings
+// have already been printed by emit.
+func writeFindings(w io.Writer) error {
+	findingsMu.Lock()
+	defer findingsMu.Unlock()
+
+	switch *outputFormat {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		list := findings
+		if list == nil {
+			list = []Finding{}
+		}
+		return enc.Encode(list)
+	case "jsonl":
+		enc := json.NewEncoder(w)
+		for _, f := range findings {
+			if err := enc.Encode(f); err != nil {
+				return err
+			}
+		}
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"severity", "rule_id", "ca_owner", "ca_fingerprint", "stores", "trust_bits", "issuer_dn", "aki", "crl_url", "path", "message", "evidence"})
+		for _, f := range findings {
+			var evidence []string
+			for _, k := range sortedKeys(f.Evidence) {
+				evidence = append(evidence, k+"="+f.Evidence[k])
+			}
+			cw.Write([]string{f.Severity, f.RuleID, f.CAOwner, f.CAFingerprint, strings.Join(f.Stores, ";"), f.TrustBits, f.IssuerDN, f.AKI, f.CRLURL, f.Path, f.Message, strings.Join(evidence, "; ")})
+		}
+		cw.Flush()
+		return cw.Error()
+	}
+	return nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// httpClient is shared by all downloads so connections to a CA host are reused.
+var httpClient *http.Client
+
+func newHTTPClient() *http.Client {
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   15 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          *workers,
+		MaxIdleConnsPerHost:   *perHostLimit,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	return &http.Client{
+		Transport: transport,
+		Timeout:   *clientTimeout,
+	}
+}
+
+// job is a unit of work for runJobs. Jobs with an empty host do not talk to
+// a server and are not subject to the per-host limit.
+type job struct {
+	host string
+	run  func()
+}
+
+// runJobs runs the jobs on a fixed number of workers and never runs more
+// than perHostLimit jobs against the same host at once.
+func runJobs(jobs []job) {
+	slots := map[string]chan struct{}{}
+	for _, j := range jobs {
+		if j.host != "" && slots[j.host] == nil {
+			slots[j.host] = make(chan struct{}, max(*perHostLimit, 1))
+		}
+	}
+
+	queue := make(chan job)
+	var wg sync.WaitGroup
+	for i := 0; i < max(*workers, 1); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range queue {
+				slot := slots[j.host]
+				if slot != nil {
+					slot <- struct{}{}
+				}
+				j.run()
+				if slot != nil {
+					<-slot
+				}
+			}
+		}()
+	}
+
+	for _, j := range interleaveByHost(jobs) {
+		queue <- j
+	}
+	close(queue)
+	wg.Wait()
+}
+
+// interleaveByHost orders the jobs round-robin by host, so workers are not
+// all stuck waiting for the same busy host.
+func interleaveByHost(jobs []job) []job {
+	var hosts []string
+	byHost := map[string][]job{}
+	for _, j := range jobs {
+		if _, ok := byHost[j.host]; !ok {
+			hosts = append(hosts, j.host)
+		}
+		byHost[j.host] = append(byHost[j.host], j)
+	}
+
+	out := make([]job, 0, len(jobs))
+	for len(out) < len(jobs) {
+		for _, host := range hosts {
+			if queued := byHost[host]; len(queued) > 0 {
+				out = append(out, queued[0])
+				byHost[host] = queued[1:]
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+var (
+	querySerial = new(string)
+	queryIssuer = new(string)
+)
+
+// localCRL is a parsed CRL file below outputBaseDir.
+type localCRL struct {
+	Path string
+	CRL  *x509.RevocationList
+	// DeltaPath and Delta are the newest delta CRL of CRL, if any.
+	DeltaPath string
+	Delta     *x509.RevocationList
+	// Entries are the revocations of CRL merged with its delta CRL.
+	Entries []x509.RevocationListEntry
+}
+
+// revocation is a match of a serial number on a CRL.
+type revocation struct {
+	Path           string    `json:"path"`
+	Issuer         string    `json:"issuer"`
+	Serial         string    `json:"serial"`
+	RevocationTime time.Time `json:"revocationTime"`
+	Reason         string    `json:"reason"`
+	// Delta is the delta CRL the entry is from, if it is not on the complete CRL.
+	Delta string `json:"delta,omitempty"`
+}
+
+// loadLocalCRLs parses every CRL below baseDir and merges the delta CRLs
+// into their complete CRLs. Unparsable files are skipped, check reports them.
+func loadLocalCRLs(baseDir string) ([]localCRL, error) {
+	var out []localCRL
+	err := filepath.Walk(baseDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || filepath.Ext(path) != ".crl" {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil
+		}
+		_, crl, err := parseCRL(data)
+		if err != nil {
+			if *debugLogging {
+				logln("Skipping unparsable CRL", path, "error:", err)
+			}
+			return nil
+		}
+		out = append(out, localCRL{Path: path, CRL: crl})
+		return nil
+	})
+	return pairDeltas(out), err
+}
+
+// parseSerial parses a hex serial number as shown by crt.sh or openssl,
+// with or without colons and 0x prefix.
+func parseSerial(s string) (*big.Int, error) {
+	s = strings.NewReplacer(":", "", " ", "").Replace(strings.TrimSpace(s))
+	s = strings.TrimPrefix(strings.ToLower(s), "0x")
+	serial, ok := new(big.Int).SetString(s, 16)
+	if !ok || s == "" {
+		return nil, fmt.Errorf("invalid hex serial number %q", s)
+	}
+	return serial, nil
+}
+
+func formatSerial(serial *big.Int) string {
+	return strings.ToUpper(serial.Text(16))
+}
+
+// findRevocations returns every entry for serial on the given CRLs.
+// issuer, if set, restricts the search to CRLs whose issuer DN is or,
+// if it is not a DN, contains it.
+func findRevocations(crls []localCRL, serial *big.Int, issuer string) []revocation {
+	var out []revocation
+	issuerDN, err := parseDN(issuer)
+	isDN := err == nil && strings.Contains(issuer, "=")
+	for _, c := range crls {
+		switch {
+		case issuer == "":
+		case isDN:
+			if normalizeDN(c.CRL.Issuer.String()) != issuerDN.normalized() {
+				continue
+			}
+		case !strings.Contains(strings.ToLower(c.CRL.Issuer.String()), strings.ToLower(issuer)):
+			continue
+		}
+		for _, entry := range c.Entries {
+			if entry.SerialNumber.Cmp(serial) == 0 {
+				r := revocation{
+					Path:           c.Path,
+					Issuer:         c.CRL.Issuer.String(),
+					Serial:         formatSerial(entry.SerialNumber),
+					RevocationTime: entry.RevocationTime,
+					Reason:         reasonName(entry.ReasonCode),
+				}
+				if c.Delta != nil && slices.ContainsFunc(c.Delta.RevokedCertificateEntries, func(e x509.RevocationListEntry) bool {
+					return e.SerialNumber.Cmp(serial) == 0
+				}) {
+					r.Delta = c.DeltaPath
+				}
+				out = append(out, r)
+			}
+		}
+	}
+	return out
+}
+
+func queryFlags(fs *flag.FlagSet) {
+	fs.StringVar(querySerial, "serial", "", "hex serial number of the certificate (required)")
+	fs.StringVar(queryIssuer, "issuer", "", "only search CRLs issued by this DN, or whose issuer DN contains this text")
+}
+
+func query(fs *flag.FlagSet) int {
+	if *querySerial == "" {
+		fs.Usage()
+		return exitUsage
+	}
+	serial, err := parseSerial(*querySerial)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+
+	crls, err := loadLocalCRLs(outputBaseDir)
+	if err != nil {
+		logln("Error reading CRLs:", err)
+		return exitError
+	}
+
+	matches := findRevocations(crls, serial, *queryIssuer)
+	if len(matches) == 0 {
+		fmt.Printf("Serial %s not found on %d CRLs.\n", formatSerial(serial), len(crls))
+		return exitFindings
+	}
+	for _, m := range matches {
+		fmt.Printf("Serial %s revoked at %s, reason %s\n", m.Serial, m.RevocationTime.Format(time.RFC3339), m.Reason)
+		fmt.Printf("  Issuer: %s\n  CRL: %s\n", m.Issuer, m.Path)
+		if m.Delta != "" {
+			fmt.Printf("  Delta CRL: %s\n", m.Delta)
+		}
+	}
+	return exitOK
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// maxRetryAfter caps how long we honour a Retry-After header. Servers asking
+// for a longer pause are given up on until the next run.
+const maxRetryAfter = 2 * time.Minute
+
+// downloadAttempt records the outcome of a single HTTP request for a CRL.
+type downloadAttempt struct {
+	Time   time.Time     `json:"time"`
+	Status int           `json:"status,omitempty"`
+	Error  string        `json:"error,omitempty"`
+	Wait   time.Duration `json:"wait,omitempty"`
+}
+
+// fetch sends req and retries timeouts, 429 and 5xx responses with jittered
+// exponential backoff. The body of the final response is read and returned,
+// resp.Body is already closed.
+func fetch(req *http.Request) (resp *http.Response, body []byte, attempts []downloadAttempt, err error) {
+	for n := 0; ; n++ {
+		attempt := downloadAttempt{Time: time.Now().UTC()}
+		resp, body, err = fetchOnce(req)
+		if resp != nil {
+			attempt.Status = resp.StatusCode
+		}
+		if err != nil {
+			attempt.Error = err.Error()
+		}
+
+		if !retryable(resp, err) || n >= *retries {
+			attempts = append(attempts, attempt)
+			return resp, body, attempts, err
+		}
+
+		wait := backoff(n)
+		if after, ok := retryAfter(resp); ok {
+			if after > maxRetryAfter {
+				attempt.Error = fmt.Sprintf("Retry-After %s exceeds %s", after, maxRetryAfter)
+				attempts = append(attempts, attempt)
+				return resp, body, attempts, err
+			}
+			wait = after
+		}
+		attempt.Wait = wait
+		attempts = append(attempts, attempt)
+		if *debugLogging {
+			logf("Retrying %s in %s (attempt %d): status %d %v\n", req.URL, wait, n+1, attempt.Status, err)
+		}
+		time.Sleep(wait)
+	}
+}
+
+func fetchOnce(req *http.Request) (*http.Response, []byte, error) {
+	resp, err := httpClient.Do(req.Clone(req.Context()))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return resp, body, err
+}
+
+func retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+}
+
+// backoff returns the delay before retry n+1: retryDelay doubled per attempt,
+// with jitter so workers do not hit a host in lockstep.
+func backoff(n int) time.Duration {
+	d := *retryDelay << n
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + rand.N(d/2+1)
+}
+
+// retryAfter parses the Retry-After header of 429 and 503 responses.
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	if resp == nil || (resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable) {
+		return 0, false
+	}
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return max(time.Until(t), 0), true
+	}
+	return 0, false
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	serveListen = new(string)
+	serveReload = new(time.Duration)
+)
+
+// crlSummary is the /crls view of a CRL.
+type crlSummary struct {
+	Path       string    `json:"path"`
+	Issuer     string    `json:"issuer"`
+	Number     string    `json:"crlNumber,omitempty"`
+	ThisUpdate time.Time `json:"thisUpdate"`
+	NextUpdate time.Time `json:"nextUpdate"`
+	Entries    int       `json:"entries"`
+	Expired    bool      `json:"expired"`
+	// Delta and DeltaNumber name the delta CRL merged into Entries.
+	Delta       string `json:"delta,omitempty"`
+	DeltaNumber string `json:"deltaCrlNumber,omitempty"`
+}
+
+// crlServer answers HTTP requests from the CRLs loaded at the last reload.
+type crlServer struct {
+	mu       sync.RWMutex
+	crls     []localCRL
+	loadedAt time.Time
+}
+
+func (s *crlServer) reload() error {
+	crls, err := loadLocalCRLs(outputBaseDir)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.crls, s.loadedAt = crls, time.Now()
+	s.mu.Unlock()
+	logf("Loaded %d CRLs.\n", len(crls))
+	return nil
+}
+
+func (s *crlServer) handleCRLs(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := make([]crlSummary, 0, len(s.crls))
+	for _, c := range s.crls {
+		summary := crlSummary{
+			Path:       c.Path,
+			Issuer:     c.CRL.Issuer.String(),
+			ThisUpdate: c.CRL.ThisUpdate,
+			NextUpdate: c.CRL.NextUpdate,
+			Entries:    len(c.Entries),
+			Expired:    time.Now().After(c.CRL.NextUpdate),
+			Delta:      c.DeltaPath,
+		}
+		if c.CRL.Number != nil {
+			summary.Number = c.CRL.Number.String()
+		}
+		if c.Delta != nil && c.Delta.Number != nil {
+			summary.DeltaNumber = c.Delta.Number.String()
+		}
+		out = append(out, summary)
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+func (s *crlServer) handleQuery(w http.ResponseWriter, r *http.Request) {
+	serial, err := parseSerial(r.URL.Query().Get("serial"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	s.mu.RLock()
+	matches := findRevocations(s.crls, serial, r.URL.Query().Get("issuer"))
+	s.mu.RUnlock()
+	writeJSON(w, http.StatusOK, map[string]any{
+		"serial":      formatSerial(serial),
+		"revoked":     len(matches) > 0,
+		"revocations": matches,
+	})
+}
+
+func (s *crlServer) handleHealth(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	writeJSON(w, http.StatusOK, map[string]any{
+		"crls":     len(s.crls),
+		"loadedAt": s.loadedAt,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logln("Failed to write response:", err)
+	}
+}
+
+func serveFlags(fs *flag.FlagSet) {
+	fs.StringVar(serveListen, "listen", "127.0.0.1:8080", "address to listen on")
+	fs.DurationVar(serveReload, "reload", 15*time.Minute, "interval for reloading the CRLs from disk (0: never)")
+}
+
+func serve(fs *flag.FlagSet) int {
+	banner()
+	s := &crlServer{}
+	if err := s.reload(); err != nil {
+		logln("Error reading CRLs:", err)
+		return exitError
+	}
+	if *serveReload > 0 {
+		go func() {
+			for range time.Tick(*serveReload) {
+				if err := s.reload(); err != nil {
+					logln("Error reloading CRLs:", err)
+				}
+			}
+		}()
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", s.handleHealth)
+	mux.HandleFunc("GET /crls", s.handleCRLs)
+	mux.HandleFunc("GET /query", s.handleQuery)
+
+	logln("Listening on", *serveListen)
+	server := &http.Server{
+		Addr:              *serveListen,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	if err := server.ListenAndServe(); err != nil {
+		logln("Server failed:", err)
+		return exitError
+	}
+	return exitOK
+}
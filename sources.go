@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/pelletier/go-toml"
+)
+
+// customSources is a TOML file of CAs that are not in CCADB, e.g. internal PKIs.
+var customSources = new(string)
+
+// customCA is an entry of the custom source file:
+//
+//	[[ca]]
+//	name = "Example Issuing CA 1"
+//	owner = "Example Corp"
+//	issuer = "pki/issuing-ca-1.pem"
+//	full_crl = "http://pki.example.com/issuing-ca-1.crl"
+//	partitioned_crls = ["http://pki.example.com/issuing-ca-1-1.crl"]
+//	cadence = "24h"
+type customCA struct {
+	Name            string   `toml:"name"`
+	Owner           string   `toml:"owner"`
+	Issuer          string   `toml:"issuer"` // path of the issuer certificate, PEM or DER
+	FullCRL         string   `toml:"full_crl"`
+	PartitionedCRLs []string `toml:"partitioned_crls"`
+	// Cadence is how often the CA publishes a new CRL. check reports CRLs
+	// whose thisUpdate is older than that.
+	Cadence time.Duration `toml:"cadence"`
+}
+
+type customSourceFile struct {
+	CAs []customCA `toml:"ca"`
+}
+
+// loadCustomCAs reads the custom source file. Every entry must name the
+// certificate of its issuer and at least one CRL.
+func loadCustomCAs(path string) ([]caEntry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file customSourceFile
+	if err := toml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	var cas []caEntry
+	for i, ca := range file.CAs {
+		e, err := ca.entry(path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: ca %d (%s): %w", path, i+1, ca.Name, err)
+		}
+		cas = append(cas, e)
+	}
+	return cas, nil
+}
+
+func (ca customCA) entry(path string) (caEntry, error) {
+	if ca.Name == "" {
+		return caEntry{}, fmt.Errorf("missing name")
+	}
+	if ca.FullCRL == "" && len(ca.PartitionedCRLs) == 0 {
+		return caEntry{}, fmt.Errorf("neither full_crl nor partitioned_crls set")
+	}
+	if ca.Issuer == "" {
+		return caEntry{}, fmt.Errorf("missing issuer certificate")
+	}
+	cert, err := readCertificate(ca.Issuer)
+	if err != nil {
+		return caEntry{}, fmt.Errorf("issuer certificate: %w", err)
+	}
+
+	e := caEntry{
+		fingerprint: certFingerprint(cert.Raw),
+		pemInfo:     string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})),
+		subject:     cert.Subject.String(),
+		subjectCN:   ca.Name,
+		owner:       ca.Owner,
+		stores:      map[string]bool{},
+		sources:     []string{"custom:" + path},
+		cadence:     ca.Cadence,
+	}
+	if ca.FullCRL != "" {
+		e.crlURLs = append(e.crlURLs, ca.FullCRL)
+	}
+	e.crlURLs = append(e.crlURLs, ca.PartitionedCRLs...)
+	return e, nil
+}
+
+// readCertificate reads a PEM or DER encoded certificate.
+func readCertificate(path string) (*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if block, _ := pem.Decode(data); block != nil && block.Type == "CERTIFICATE" {
+		data = block.Bytes
+	}
+	return x509.ParseCertificate(data)
+}
@@ -1,256 +1,471 @@
 package main
 
 import (
-	"bytes"
-	"crypto/md5"
-	"encoding/csv"
+	"crypto/sha256"
+	"crypto/x509"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
-	"io"
+	"math/big"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
-	"sync"
 	"time"
 	"unicode"
 )
 
 const (
-	ccadbURL         = "https://ccadb.my.salesforce-sites.com/mozilla/MozillaIntermediateCertsCSVReport"
-	outputBaseDir    = "crls"
-	fieldIssuer      = "Issuer"
-	fieldSubject     = "Subject"
-	fieldFullCRL     = "Full CRL Issued By This CA"
-	fieldPartitioned = "JSON Array of Partitioned CRLs" // not valid JSON
+	defaultCCADBURL      = "https://ccadb.my.salesforce-sites.com/mozilla/MozillaIntermediateCertsCSVReport"
+	defaultCCADBRootsURL = "https://ccadb.my.salesforce-sites.com/mozilla/IncludedCACertificateReportPEMCSV"
+	defaultCCADBAllURL   = "https://ccadb.my.salesforce-sites.com/ccadb/AllCertificateRecordsCSVFormatv4"
+	fieldIssuer          = "Issuer"
+	fieldSubject         = "Subject"
+	fieldFullCRL         = "Full CRL Issued By This CA"
+	fieldPartitioned     = "JSON Array of Partitioned CRLs" // not valid JSON
+	fieldPEM             = "PEM Info"
+	fieldFingerprint     = "SHA-256 Fingerprint"
+	fieldCAOwner         = "CA Owner"
+	fieldOwner           = "Owner" // root report
+	fieldRecordType      = "Certificate Record Type"
+	fieldRevocation      = "Revocation Status"
+	fieldRootStatus      = "Status of Root Cert" // e.g. "Apple: Included; Google Chrome: Included; ..."
+	fieldSubjectCN       = "Certificate Subject Common Name"
+	fieldTrustBits       = "Trust Bits"
 )
 
-func updateCRLs() {
-	fmt.Println("Updating CRLs... Downloading Mozilla CCADB Root and Intermediates with Trust-Bit set")
-	resp, err := http.Get(ccadbURL)
+// Directories of the downloaded and the rejected CRLs.
+var (
+	outputBaseDir = "crls"
+	quarantineDir = "quarantine"
+)
+
+// history is the archive of every CRL version fetched by update.
+var history *crlArchive
+
+// updateCRLs refreshes the issuer store and downloads all CRLs listed in CCADB.
+// Failures of single CRLs are reported but do not make the update fail.
+func updateCRLs() error {
+	httpClient = newHTTPClient()
+	started := time.Now()
+
+	var err error
+	history, err = loadArchive()
 	if err != nil {
-		fmt.Println("Error downloading Mozilla CCADB Root CA certificate:", err)
-		return
+		return fmt.Errorf("reading CRL archive: %w", err)
 	}
-	defer resp.Body.Close()
+	defer func() {
+		if removed := history.prune(*archiveKeep, *archiveMaxAge); removed > 0 {
+			logf("Pruned %d archived CRL versions.\n", removed)
+		}
+		if err := history.save(); err != nil {
+			logln("Error writing CRL archive index:", err)
+		}
+	}()
 
-	reader := csv.NewReader(resp.Body)
-	headers, err := reader.Read()
+	store, err := newIssuerStore()
 	if err != nil {
-		fmt.Println("Error parsing Mozilla CCADB Root CA CSV Headers:", err)
-		return
+		return fmt.Errorf("creating issuer store: %w", err)
 	}
+	defer func() {
+		if err := store.save(); err != nil {
+			logln("Error writing issuer store index:", err)
+		}
+	}()
 
-	// Map header names to indices
-	index := map[string]int{}
-	for i, h := range headers {
-		index[strings.TrimSpace(h)] = i
+	stores, err := parseStores(*updateStores)
+	if err != nil {
+		return err
 	}
-
-	requiredFields := []string{fieldSubject, fieldIssuer, fieldFullCRL, fieldPartitioned}
-	for _, f := range requiredFields {
-		if _, ok := index[f]; !ok {
-			fmt.Println("Missing required field in csv:", f)
-			return
-		}
+	if len(stores) == 0 && *customSources == "" {
+		return fmt.Errorf("no root store and no custom source selected")
 	}
-
-	fmt.Println("Download and parsing done. Downloading CRLs.")
-	var wg sync.WaitGroup
-	for {
-		record, err := reader.Read()
-		if err == io.EOF {
-			break
+	var cas []caEntry
+	scope := orphanScope{sources: map[string]bool{}, stores: stores}
+	if len(stores) > 0 {
+		logln("Updating issuer store and CRLs... Downloading CCADB reports for root stores", strings.Join(stores, ", "))
+		var loaded []string
+		cas, loaded, err = loadCAs(stores)
+		if err != nil {
+			return err
 		}
+		for _, name := range loaded {
+			scope.sources[name] = true
+		}
+	}
+	if *customSources != "" {
+		custom, err := loadCustomCAs(*customSources)
 		if err != nil {
-			fmt.Printf("Skipping row due to error: %v\n", err)
-			continue
+			return fmt.Errorf("loading custom sources: %w", err)
 		}
+		logf("Loaded %d CAs from %s.\n", len(custom), *customSources)
+		cas = append(cas, custom...)
+		scope.sources["custom:"+*customSources] = true
+	}
 
-		subjectRaw := record[index[fieldSubject]]
-		issuer := sanitize(record[index[fieldIssuer]])
-		fullCRL := strings.TrimSpace(record[index[fieldFullCRL]])
-		partCRLJSON := strings.TrimSpace(record[index[fieldPartitioned]])
-
-		_, orgName := parseIssuerDN(issuer)
-		subject, _ := parseIssuerDN(subjectRaw)
-
-		dir := filepath.Join(outputBaseDir, orgName, "/", subject)
-		if err := os.MkdirAll(dir, 0755); err != nil {
-			fmt.Printf("Failed to create dir %s: %v\n", dir, err)
-			continue
+	logln("Download and parsing done. Downloading CRLs.")
+	previous, err := loadManifest()
+	if err != nil {
+		logln("Error reading CRL manifest:", err)
+	}
+	manifest := &crlManifest{Files: map[string]manifestEntry{}}
+	crlFiles = manifest
+	// planned maps every URL to the one path it is stored at. A URL shared by
+	// several CA certificates, e.g. cross-signed ones, goes to the first path
+	// in sort order, so it stays put between updates.
+	planned := map[string]string{}
+	for _, ca := range cas {
+		for _, url := range ca.crlURLs {
+			dest := crlFilePath(ca, url)
+			if first, ok := planned[cleanURL(url)]; !ok || dest < first {
+				planned[cleanURL(url)] = dest
+			}
 		}
-
-		if fullCRL != "" {
-			wg.Add(1)
-			savePath := filepath.Join(dir, filepath.Base(fullCRL))
-			go func() {
-				defer wg.Done()
-				downloadCRL(fullCRL, savePath)
-			}()
+	}
+	legacy := map[string]string{}
+	var jobs, issuerJobs []job
+	queued := map[string]bool{}
+	for _, ca := range cas {
+		issuerHost := ""
+		if ca.pemInfo == "" {
+			issuerHost = hostOf(crtshDownloadURL)
 		}
+		issuerJobs = append(issuerJobs, job{host: issuerHost, run: func() {
+			if err := store.add(ca.pemInfo, ca.fingerprint, ca.subject, ca.owner, ca.root, ca.storeList()); err != nil {
+				logln("Unable to store issuer certificate", ca.name(), "error:", err)
+			}
+		}})
 
-		if partCRLJSON != "" && partCRLJSON != "[]" {
-			urls, err := parsePartitionedURLs(partCRLJSON)
-			if err != nil {
-				fmt.Println("bad partitioned‑CRL list for", issuer, "error:", err)
+		for _, url := range ca.crlURLs {
+			dest := crlFilePath(ca, url)
+			if queued[dest] {
 				continue
 			}
-			for _, url := range urls {
-				wg.Add(1)
-				save := filepath.Join(dir, filepath.Base(url))
-				go func() {
-					defer wg.Done()
-					downloadCRL(url, save)
-				}()
+			first := planned[cleanURL(url)]
+			if old := legacyCRLPath(ca, url); old != "" {
+				if _, ok := legacy[old]; !ok {
+					legacy[old] = first
+				}
 			}
+			if dest != first {
+				queued[dest] = true
+				entry := ca.manifestEntry(url)
+				entry.SameAs, _ = filepath.Rel(outputBaseDir, first)
+				entry.SameAs = filepath.ToSlash(entry.SameAs)
+				manifest.add(dest, entry)
+				continue
+			}
+			if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+				logf("Failed to create dir %s: %v\n", filepath.Dir(dest), err)
+				continue
+			}
+			queued[dest] = true
+			manifest.add(dest, ca.manifestEntry(url))
+			jobs = append(jobs, crlJob(url, dest, ca.cadence))
 		}
 	}
-	wg.Wait()
-	fmt.Println("Done!")
+	migrateLegacyLayout(manifest, planned, legacy)
+	if err := manifest.save(); err != nil {
+		logln("Error writing CRL manifest:", err)
+	}
+	runJobs(issuerJobs)
+	logf("Downloading %d CRLs with %d workers.\n", len(jobs), *workers)
+	runJobs(jobs)
+	if deltaJobs := planDeltaCRLs(manifest); len(deltaJobs) > 0 {
+		logf("Downloading %d delta CRLs.\n", len(deltaJobs))
+		runJobs(deltaJobs)
+	}
+	compareVersions(manifest, started)
+	if len(planned) > 0 {
+		collectOrphans(manifest, previous, scope, *deleteOrphans)
+	} else {
+		logln("No CRLs listed, keeping the CRLs of the last update.")
+	}
+	if err := manifest.save(); err != nil {
+		logln("Error writing CRL manifest:", err)
+	}
+	logln("Done!")
+	conditionalReport(outputBaseDir)
+	availabilityReport(outputBaseDir)
+	return nil
+}
+
+// field returns the named column of a CSV record or "" if the report does not have it.
+func field(record []string, index map[string]int, name string) string {
+	i, ok := columnIndex(index, name)
+	if !ok || i >= len(record) {
+		return ""
+	}
+	return strings.TrimSpace(record[i])
+}
+
+func crlJob(url, destPath string, cadence time.Duration) job {
+	return job{host: hostOf(cleanURL(url)), run: func() {
+		downloadCRL(url, destPath, cadence)
+	}}
+}
+
+// hostOf returns the host of a URL, or the URL itself if it does not parse.
+func hostOf(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return raw
+	}
+	return strings.ToLower(u.Host)
 }
 
-func downloadCRL(url, destPath string) {
-	// if the local etag is missing just continue and grab a new file.
-	localETag, err := computeETag(destPath)
+// downloadCRL fetches the CRL at url into destPath. cadence is the expected
+// publication interval of the CA, if known.
+func downloadCRL(url, destPath string, cadence time.Duration) {
+	meta, err := loadMeta(destPath)
 	if err != nil {
-		fmt.Printf("Failed to compute ETag. File might be missing: %v\n", err)
+		logf("Failed to read metadata of %s: %v\n", destPath, err)
+	}
+	// Validators are worthless if the file they describe is gone.
+	if _, err := os.Stat(destPath); err != nil {
+		meta.ETag, meta.LastModified, meta.SHA256 = "", "", ""
 	}
 
 	url = cleanURL(url)
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
-		fmt.Println("failed to create GET request:", err)
+		logln("failed to create GET request:", err)
 		return
 	}
 
-	client := &http.Client{
-		Timeout: time.Second * clientTimeout,
+	// Send back the validators the server gave us last time.
+	// If our copy is still current the server responds with 304 Not Modified.
+	conditional := meta.ETag != "" || meta.LastModified != ""
+	if meta.ETag != "" {
+		req.Header.Set("If-None-Match", meta.ETag)
+	}
+	if meta.LastModified != "" {
+		req.Header.Set("If-Modified-Since", meta.LastModified)
 	}
 
-	// If-None-Match uses the etag (basically md5) to compare our local File against the File on the Server.
-	// The Server checks the etag of his file against what we sent him.
-	// If it does not match the Server responds with 200 OK and sends over the new File.
-	// If it matches we get a 304 Not Modified.
-	if localETag != "" {
-		req.Header.Set("If-None-Match", localETag)
+	meta.URL = url
+	meta.Cadence = cadence
+	meta.Requests++
+	if conditional {
+		meta.ConditionalRequests++
 	}
+	defer func() {
+		if err := saveMeta(destPath, meta); err != nil {
+			logf("Failed to write metadata of %s: %v\n", destPath, err)
+		}
+	}()
 
-	resp, err := client.Do(req)
+	resp, body, attempts, err := fetch(req)
+	meta.LastFetched = time.Now().UTC()
+	meta.recordAttempts(attempts, err == nil && (resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusNotModified))
 	if err != nil {
-		fmt.Printf("Download failed for %s: %v\n", url, err)
+		logf("Download failed for %s after %d attempts: %v\n", url, len(attempts), err)
 		return
 	}
-	defer resp.Body.Close()
+	meta.LastStatus = resp.StatusCode
 
 	if resp.StatusCode == http.StatusNotModified {
+		meta.NotModified++
 		if *debugLogging {
-			fmt.Println("Skipped download, CRL not modified. CRL:", url)
+			logln("Skipped download, CRL not modified. CRL:", url)
 		}
 		return
 	}
 
 	if resp.StatusCode != 200 {
-		fmt.Printf("Non-200 for %s: %d\n", url, resp.StatusCode)
+		logf("Non-200 for %s: %d (attempts: %d)\n", url, resp.StatusCode, len(attempts))
 		return
 	}
 
-	body, err := io.ReadAll(resp.Body)
+	if len(body) == 0 {
+		logf("Empty response body for %s. Err: %d\n", url, resp.StatusCode)
+	}
+
+	sum := sha256.Sum256(body)
+	digest := hex.EncodeToString(sum[:])
+	if conditional && digest == meta.SHA256 {
+		meta.UnchangedDownloads++
+	}
+	// Only a parsable CRL may replace the last good copy.
+	_, crl, err := parseCRL(body)
 	if err != nil {
-		fmt.Printf("Failed to read response body for %s. Err: %s\n", url, err)
+		meta.Quarantined++
+		if err := quarantine(url, destPath, resp.Header.Get("Content-Type"), body, err.Error()); err != nil {
+			logf("Failed to quarantine response of %s: %v\n", url, err)
+		}
+		logf("Rejected %s, response is not a CRL: %v\n", url, err)
 		return
 	}
+	checkSequence(destPath, meta, crl, digest)
+	if err := writeFileAtomic(destPath, body); err != nil {
+		logf("Write error for %s: %v\n", destPath, err)
+		return
+	}
+	if err := history.add(url, destPath, digest, body, crl, meta.LastFetched); err != nil {
+		logf("Failed to archive %s: %v\n", url, err)
+	}
+	meta.ETag = resp.Header.Get("ETag")
+	meta.LastModified = resp.Header.Get("Last-Modified")
+	meta.SHA256 = digest
+}
 
-	if len(body) == 0 {
-		fmt.Printf("Empty response body for %s. Err: %d\n", url, resp.StatusCode)
+// checkSequence compares a downloaded CRL with the last one from the same URL.
+// RFC 5280 section 5.2.3 requires increasing CRL numbers, so a lower number,
+// the same number on changed content or an older thisUpdate point to a
+// rollback or a CDN serving stale copies.
+func checkSequence(destPath string, meta *crlMeta, crl *x509.RevocationList, digest string) {
+	ctx := newCRLContext(destPath)
+	ctx.setCRL(crl)
+	evidence := func() map[string]string {
+		ev := map[string]string{"previousThisUpdate": meta.ThisUpdate.Format(time.RFC3339), "thisUpdate": crl.ThisUpdate.Format(time.RFC3339)}
+		if meta.CRLNumber != "" {
+			ev["previousCRLNumber"] = meta.CRLNumber
+		}
+		if crl.Number != nil {
+			ev["crlNumber"] = crl.Number.String()
+		}
+		return ev
 	}
 
-	out, err := os.Create(destPath)
-	if err != nil {
-		fmt.Printf("File create error for %s: %v\n", destPath, err)
-		return
+	previous, ok := new(big.Int).SetString(meta.CRLNumber, 10)
+	if ok && crl.Number != nil {
+		switch crl.Number.Cmp(previous) {
+		case -1:
+			emit(ctx.finding(severityError, "crl_number_decreased", fmt.Sprintf("CRL number %s is lower than %s of the previous download", crl.Number, previous), evidence()))
+		case 0:
+			if meta.SHA256 == "" || digest == meta.SHA256 {
+				break
+			}
+			emit(ctx.finding(severityError, "crl_number_not_increased", fmt.Sprintf("CRL content changed but the CRL number stayed %s", crl.Number), evidence()))
+		}
+	}
+	if crl.ThisUpdate.Before(meta.ThisUpdate) {
+		emit(ctx.finding(severityError, "crl_this_update_decreased", fmt.Sprintf("thisUpdate %s is before %s of the previous download", crl.ThisUpdate.Format(time.RFC3339), meta.ThisUpdate.Format(time.RFC3339)), evidence()))
 	}
-	defer out.Close()
 
-	reader := bytes.NewReader(body)
-	written, err := io.Copy(out, reader)
-	if err != nil || written != int64(len(body)) {
-		fmt.Println("Write error for", destPath, "Written Bytes:", written, "error:", err)
+	if crl.Number != nil && (!ok || crl.Number.Cmp(previous) > 0) {
+		meta.CRLNumber = crl.Number.String()
+	}
+	if crl.ThisUpdate.After(meta.ThisUpdate) {
+		meta.ThisUpdate = crl.ThisUpdate
 	}
 }
 
-func sanitize(s string) string {
-	s = strings.ReplaceAll(s, "/", "_")
-	s = strings.ReplaceAll(s, "\\", "_")
-	s = strings.ReplaceAll(s, ":", "_")
-	s = strings.ReplaceAll(s, "*", "_")
-	s = strings.ReplaceAll(s, "?", "_")
-	s = strings.ReplaceAll(s, "\"", "_")
-	s = strings.ReplaceAll(s, "<", "_")
-	s = strings.ReplaceAll(s, ">", "_")
-	s = strings.ReplaceAll(s, "|", "_")
-	s = strings.ReplaceAll(s, "?", "_")
-	s = strings.TrimSpace(s)
-	if s == "" {
-		return "unknown"
-	}
-	return s
-}
+// writeFileAtomic writes data to a temporary file next to path and renames
+// it into place, so path either keeps its old content or has all of data.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".download-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
 
-func parsePartitionedURLs(raw string) ([]string, error) {
-	trimmed := strings.TrimPrefix(strings.TrimSuffix(raw, "]"), "[")
-	parts := strings.Split(trimmed, ",")
-	for i, p := range parts {
-		parts[i] = strings.TrimSpace(p)
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
 	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
 
-	// filter out empty entries
-	var out []string
-	for _, u := range parts {
-		if u != "" {
-			out = append(out, u)
-		}
+// quarantine keeps a rejected download for inspection together with the reason.
+// The files are named by URL and content, the same error page served for many
+// URLs is kept once per URL.
+func quarantine(url, destPath, contentType string, body []byte, reason string) error {
+	if err := os.MkdirAll(quarantineDir, 0755); err != nil {
+		return err
 	}
-	if len(out) == 0 {
-		return nil, fmt.Errorf("no URLs found in %q", raw)
+	sum := sha256.Sum256(body)
+	name := filepath.Join(quarantineDir, urlHash(url)+"-"+hex.EncodeToString(sum[:]))
+	if err := os.WriteFile(name+".bin", body, 0644); err != nil {
+		return err
 	}
-	return out, nil
+	note, err := json.MarshalIndent(map[string]string{
+		"url":         url,
+		"path":        destPath,
+		"contentType": contentType,
+		"reason":      reason,
+		"time":        time.Now().UTC().Format(time.RFC3339),
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(name+".json", note, 0644)
 }
 
-func parseIssuerDN(dn string) (cn, org string) {
-	parts := strings.FieldsFunc(dn, func(r rune) bool {
-		return r == ',' || r == ';'
-	})
-	for _, part := range parts {
-		part = strings.TrimSpace(part)
-		if strings.HasPrefix(part, "CN=") {
-			cn = strings.TrimPrefix(part, "CN=")
-		} else if strings.HasPrefix(part, "O=") {
-			org = strings.TrimPrefix(part, "O=")
+// urlStart finds the beginning of every CRL URL in a partitioned CRL list.
+var urlStart = regexp.MustCompile(`(?i)https?://`)
+
+// parsePartitionedURLs reads the partitioned CRL column of a CCADB report.
+// It is meant to be a JSON array, but often the entries are not quoted or
+// not separated by commas. Valid URLs are returned in urls, every fragment
+// that is not a usable URL in malformed.
+func parsePartitionedURLs(raw string) (urls, malformed []string) {
+	raw = strings.TrimSpace(raw)
+	var entries []string
+	if err := json.Unmarshal([]byte(raw), &entries); err != nil {
+		entries = splitAlmostJSON(raw)
+	}
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		switch {
+		case entry == "":
+		case validCRLURL(entry):
+			urls = append(urls, entry)
+		default:
+			malformed = append(malformed, entry)
 		}
 	}
-	return
+	return urls, malformed
 }
 
-func computeETag(path string) (string, error) {
-	f, err := os.Open(path)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return "", nil // no file yet
-		}
-		return "", err
+// splitAlmostJSON splits a list at the start of every http(s) URL. A URL ends
+// at the first whitespace, anything else between the URLs is kept as a
+// fragment of its own so it can be reported.
+func splitAlmostJSON(raw string) []string {
+	raw = strings.TrimSuffix(strings.TrimPrefix(raw, "["), "]")
+	bounds := []int{0}
+	for _, loc := range urlStart.FindAllStringIndex(raw, -1) {
+		bounds = append(bounds, loc[0])
 	}
-	defer f.Close()
+	bounds = append(bounds, len(raw))
 
-	hasher := md5.New()
-	_, err = io.Copy(hasher, f)
-	if err != nil {
-		return "", err
+	var out []string
+	for i := 0; i+1 < len(bounds); i++ {
+		fields := strings.Fields(raw[bounds[i]:bounds[i+1]])
+		// Every chunk but the first starts with a URL.
+		if i > 0 && len(fields) > 0 {
+			out = append(out, trimListSeparators(fields[0]))
+			fields = fields[1:]
+		}
+		out = append(out, trimListSeparators(strings.Join(fields, " ")))
 	}
+	return out
+}
 
-	sum := hasher.Sum(nil)
-	// wrap in quotes so it looks like a real ETag header
-	return `"` + hex.EncodeToString(sum) + `"`, nil
+func trimListSeparators(s string) string {
+	return strings.Trim(s, ",;\"' \t")
+}
+
+// validCRLURL reports whether s is an absolute http(s) URL.
+func validCRLURL(s string) bool {
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" || strings.ContainsAny(s, " \t\"") {
+		return false
+	}
+	scheme := strings.ToLower(u.Scheme)
+	return scheme == "http" || scheme == "https"
 }
 
 // Sometimes there are wild things in the URLs..
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"cmp"
+	"crypto/x509"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxListedSerials limits the serial numbers listed in the evidence of a finding.
+const maxListedSerials = 20
+
+// compareVersions compares every complete CRL fetched since the start of
+// the update with its previous archived version. A URL shared by several CA
+// certificates, e.g. cross-signed ones, is compared once, where it is stored.
+func compareVersions(m *crlManifest, since time.Time) {
+	m.mu.Lock()
+	files := maps.Clone(m.Files)
+	m.mu.Unlock()
+
+	shards := map[string]map[string]bool{}
+	published := map[string]map[string]bool{}
+	backdated := map[string][]backdatedEntry{}
+	cas := map[string]crlContext{}
+	byDir := map[string][]manifestEntry{}
+	for rel, entry := range files {
+		dir := filepath.Join(outputBaseDir, filepath.Dir(filepath.FromSlash(rel)))
+		byDir[dir] = append(byDir[dir], entry)
+	}
+	for _, rel := range slices.Sorted(maps.Keys(files)) {
+		entry := files[rel]
+		if entry.DeltaOf != "" || entry.SameAs != "" {
+			continue
+		}
+		versions := history.versions(entry.URL)
+		if len(versions) < 2 || versions[len(versions)-1].FetchedAt.Before(since) {
+			continue
+		}
+		previous, current := versions[len(versions)-2], versions[len(versions)-1]
+		prevCRL, err := previous.load()
+		if err != nil {
+			logln("Unable to load the previous version of", entry.URL, "error:", err)
+			continue
+		}
+		crl, err := current.load()
+		if err != nil {
+			logln("Unable to load the current version of", entry.URL, "error:", err)
+			continue
+		}
+		if isDeltaCRL(crl) {
+			continue
+		}
+
+		path := filepath.Join(outputBaseDir, filepath.FromSlash(rel))
+		ctx := newCRLContext(path)
+		ctx.setCRL(crl)
+		dir := filepath.Dir(path)
+		checkRemovedSerials(ctx, prevCRL, crl, func() map[string]bool {
+			if shards[dir] == nil {
+				shards[dir] = caSerials(dir)
+			}
+			return shards[dir]
+		})
+
+		if published[dir] == nil {
+			published[dir] = publishedSerials(byDir[dir], since)
+		}
+		if entries := findBackdated(prevCRL, crl, published[dir]); len(entries) > 0 {
+			backdated[dir] = append(backdated[dir], entries...)
+			if _, ok := cas[dir]; !ok {
+				cas[dir] = ctx
+			}
+		}
+	}
+
+	for _, dir := range slices.Sorted(maps.Keys(backdated)) {
+		reportBackdated(cas[dir], dir, backdated[dir])
+	}
+}
+
+// caSerials returns the serial numbers on all CRLs in the directory of a CA.
+func caSerials(dir string) map[string]bool {
+	serials := map[string]bool{}
+	files, _ := filepath.Glob(filepath.Join(dir, "*.crl"))
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		_, crl, err := parseCRL(data)
+		if err != nil || isDeltaCRL(crl) {
+			continue
+		}
+		for _, e := range crl.RevokedCertificateEntries {
+			serials[e.SerialNumber.String()] = true
+		}
+	}
+	return serials
+}
+
+// checkRemovedSerials reports serials that were on the previous version of a
+// CRL but are missing from crl. A revoked certificate must stay listed until
+// it expires. Released certificateHolds and serials that moved to another
+// CRL of the CA, as returned by shards, are fine. With expiredCertsOnCRL the
+// CA promises to keep certificates that expired after that date, so a serial
+// revoked after it must still be there. Without it the certificate has most
+// likely expired, which we cannot tell without the certificate, so that is
+// only reported as info.
+func checkRemovedSerials(ctx crlContext, previous, crl *x509.RevocationList, shards func() map[string]bool) {
+	current := make(map[string]bool, len(crl.RevokedCertificateEntries))
+	for _, e := range crl.RevokedCertificateEntries {
+		current[e.SerialNumber.String()] = true
+	}
+	keptSince, err := parseExpiredCertsOnCRL(crl)
+	if err != nil {
+		emit(ctx.finding(severityWarn, "crl_expired_certs_on_crl_invalid", "unable to parse the expiredCertsOnCRL extension: "+err.Error(), nil))
+	}
+
+	var unrevoked, removed []string
+	for _, e := range previous.RevokedCertificateEntries {
+		serial := e.SerialNumber.String()
+		if current[serial] || e.ReasonCode == reasonCertificateHold || shards()[serial] {
+			continue
+		}
+		if !keptSince.IsZero() && !e.RevocationTime.Before(keptSince) {
+			unrevoked = append(unrevoked, formatSerial(e.SerialNumber))
+		} else {
+			removed = append(removed, formatSerial(e.SerialNumber))
+		}
+	}
+
+	evidence := func(serials []string) map[string]string {
+		ev := map[string]string{
+			"count":              strconv.Itoa(len(serials)),
+			"serials":            strings.Join(serials[:min(len(serials), maxListedSerials)], " "),
+			"previousThisUpdate": previous.ThisUpdate.Format(time.RFC3339),
+		}
+		if previous.Number != nil {
+			ev["previousCRLNumber"] = previous.Number.String()
+		}
+		if crl.Number != nil {
+			ev["crlNumber"] = crl.Number.String()
+		}
+		if !keptSince.IsZero() {
+			ev["expiredCertsOnCRL"] = keptSince.Format(time.RFC3339)
+		}
+		return ev
+	}
+	if len(unrevoked) > 0 {
+		emit(ctx.finding(severityError, "crl_serial_unrevoked", fmt.Sprintf("%d revoked serials were removed although expiredCertsOnCRL says they must stay listed", len(unrevoked)), evidence(unrevoked)))
+	}
+	if len(removed) > 0 {
+		emit(ctx.finding(severityInfo, "crl_serial_removed", fmt.Sprintf("%d revoked serials were removed, which is only allowed once the certificates expired", len(removed)), evidence(removed)))
+	}
+}
+
+// publishedSerials returns the serial numbers on the versions fetched before
+// since of the CRLs, complete and delta, of a CA.
+func publishedSerials(entries []manifestEntry, since time.Time) map[string]bool {
+	serials := map[string]bool{}
+	for _, entry := range entries {
+		versions := history.versions(entry.URL)
+		for i := len(versions) - 1; i >= 0; i-- {
+			if !versions[i].FetchedAt.Before(since) {
+				continue
+			}
+			if crl, err := versions[i].load(); err == nil {
+				for _, e := range crl.RevokedCertificateEntries {
+					serials[e.SerialNumber.String()] = true
+				}
+			}
+			break
+		}
+	}
+	return serials
+}
+
+// backdatedEntry is a new CRL entry revoked before the previous thisUpdate.
+type backdatedEntry struct {
+	serial string
+	reason string
+	gap    time.Duration
+}
+
+// findBackdated returns the entries that are new in crl, i.e. on no CRL of
+// the CA before, but whose revocation date is before the thisUpdate of the
+// previous version. The certificate was then revoked earlier than the
+// revocation was published, which Mozilla policy only allows for
+// keyCompromise.
+func findBackdated(previous, crl *x509.RevocationList, published map[string]bool) []backdatedEntry {
+	var out []backdatedEntry
+	for _, e := range crl.RevokedCertificateEntries {
+		if e.ReasonCode == reasonKeyCompromise || published[e.SerialNumber.String()] {
+			continue
+		}
+		if gap := previous.ThisUpdate.Sub(e.RevocationTime); gap > 0 {
+			out = append(out, backdatedEntry{
+				serial: formatSerial(e.SerialNumber),
+				reason: reasonName(e.ReasonCode),
+				gap:    gap,
+			})
+		}
+	}
+	return out
+}
+
+// reportBackdated reports the backdated entries of a CA, one finding per reason.
+func reportBackdated(ctx crlContext, dir string, entries []backdatedEntry) {
+	ctx.path, ctx.url = dir, ""
+	byReason := map[string][]backdatedEntry{}
+	for _, e := range entries {
+		byReason[e.reason] = append(byReason[e.reason], e)
+	}
+	for _, reason := range slices.Sorted(maps.Keys(byReason)) {
+		list := byReason[reason]
+		slices.SortFunc(list, func(a, b backdatedEntry) int { return cmp.Compare(b.gap, a.gap) })
+		serials := make([]string, 0, min(len(list), maxListedSerials))
+		for _, e := range list[:min(len(list), maxListedSerials)] {
+			serials = append(serials, e.serial+"="+e.gap.Round(time.Second).String())
+		}
+		emit(ctx.finding(severityError, "crl_revocation_backdated", fmt.Sprintf("%d new revocations with reason %s are dated up to %s before the previous CRL was issued", len(list), reason, list[0].gap.Round(time.Second)), map[string]string{
+			"reason":  reason,
+			"count":   strconv.Itoa(len(list)),
+			"maxGap":  list[0].gap.Round(time.Second).String(),
+			"minGap":  list[len(list)-1].gap.Round(time.Second).String(),
+			"serials": strings.Join(serials, " "),
+		}))
+	}
+}